@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// arcrc mirrors the parts of Arcanist's ~/.arcrc we care about: a Conduit token
+// per host, and optionally a default host.
+type arcrc struct {
+	Hosts map[string]struct {
+		Token string `json:"token"`
+	} `json:"hosts"`
+	Config struct {
+		Default string `json:"default"`
+	} `json:"config"`
+}
+
+// arcconfig mirrors the parts of a repository's .arcconfig we care about.
+// Older versions of Arcanist used conduit_uri instead of phabricator.uri.
+type arcconfig struct {
+	PhabricatorURI string `json:"phabricator.uri"`
+	ConduitURI     string `json:"conduit_uri"`
+}
+
+// Read ~/.arcrc. A missing file isn't an error; it just yields no hosts.
+func readArcrc() (arcrc, error) {
+	var rc arcrc
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return rc, nil
+	}
+	err = readJSONFile(filepath.Join(home, ".arcrc"), &rc)
+	if os.IsNotExist(err) {
+		return rc, nil
+	}
+	return rc, err
+}
+
+// Find the nearest .arcconfig in the current directory or one of its parents,
+// the same way arc locates the working copy it's run from, and return the
+// Phabricator URI it names. Returns "" if there is none.
+func readArcconfigURI() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", nil
+	}
+	for {
+		var config arcconfig
+		err := readJSONFile(filepath.Join(dir, ".arcconfig"), &config)
+		if err == nil {
+			if config.PhabricatorURI != "" {
+				return config.PhabricatorURI, nil
+			}
+			return config.ConduitURI, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// The host to use when none was given: the repository's .arcconfig wins, then
+// the default in ~/.arcrc, then the only host in ~/.arcrc if there's just one.
+func (rc arcrc) defaultHost(arcconfigURI string) string {
+	if arcconfigURI != "" {
+		return normalizeHost(arcconfigURI)
+	} else if rc.Config.Default != "" {
+		return normalizeHost(rc.Config.Default)
+	} else if len(rc.Hosts) == 1 {
+		for uri := range rc.Hosts {
+			return normalizeHost(uri)
+		}
+	}
+	return ""
+}
+
+// The token configured for the given host, or "" if there isn't one.
+func (rc arcrc) token(host string) string {
+	for uri, entry := range rc.Hosts {
+		if normalizeHost(uri) == normalizeHost(host) {
+			return entry.Token
+		}
+	}
+	return ""
+}
+
+// Arcanist keys hosts by their API URI, e.g. "https://phab.example.com/api/",
+// whereas the client wants the bare host it can append "/api/" to.
+func normalizeHost(uri string) string {
+	uri = strings.TrimRight(uri, "/")
+	uri = strings.TrimSuffix(uri, "/api")
+	return strings.TrimRight(uri, "/")
+}
+
+func readJSONFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	liburl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+// A cassette is a directory of recorded HTTP exchanges, one JSON file per
+// distinct request, which lets a session against a real instance be replayed
+// later with no network. Requests are matched on their method, URL and body
+// with the API token removed, so a cassette can be replayed with any key and
+// doesn't contain one.
+type cassetteExchange struct {
+	Request struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+		Body   string `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		Status int         `json:"status"`
+		Header http.Header `json:"header"`
+		Body   string      `json:"body"`
+	} `json:"response"`
+}
+
+// cassetteRecorder is an http.RoundTripper which saves every exchange it
+// carries to a cassette.
+type cassetteRecorder struct {
+	dir  string
+	next http.RoundTripper
+}
+
+func (c cassetteRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	var exchange cassetteExchange
+	exchange.Request.Method = req.Method
+	exchange.Request.URL = stripToken(req.URL.String())
+	exchange.Request.Body = stripToken("?" + string(reqBody))[1:]
+	exchange.Response.Status = resp.StatusCode
+	exchange.Response.Header = redactHeader(resp.Header)
+	exchange.Response.Body = string(respBody)
+
+	data, err := json.MarshalIndent(exchange, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(cassettePath(c.dir, req, reqBody), data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to record exchange: %v", err)
+	}
+	return resp, nil
+}
+
+// cassettePlayer is an http.RoundTripper which answers requests from a
+// cassette instead of the network, and fails any request it has no recording
+// of.
+type cassettePlayer struct {
+	dir string
+}
+
+func (c cassettePlayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	file := cassettePath(c.dir, req, reqBody)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf(
+			"replay: no recording of %s %s in %s (expected %s)",
+			req.Method,
+			scraper.RedactURL(req.URL.String()),
+			c.dir,
+			filepath.Base(file),
+		)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var exchange cassetteExchange
+	if err := json.Unmarshal(data, &exchange); err != nil {
+		return nil, fmt.Errorf("replay: %s: %v", file, err)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", exchange.Response.Status, http.StatusText(exchange.Response.Status)),
+		StatusCode:    exchange.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        exchange.Response.Header,
+		Body:          ioutil.NopCloser(strings.NewReader(exchange.Response.Body)),
+		ContentLength: int64(len(exchange.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// The file a request's exchange is stored in: the Conduit method for
+// readability, and a hash of the request without its token for uniqueness,
+// e.g. "file.download-3f2a9c1b7d4e.json".
+func cassettePath(dir string, req *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n", req.Method, stripToken(req.URL.String()))
+	hash.Write([]byte(stripToken("?" + string(body))))
+	sum := hex.EncodeToString(hash.Sum(nil))[:12]
+	return filepath.Join(dir, path.Base(req.URL.Path)+"-"+sum+".json")
+}
+
+// Copy a response's headers with any cookies redacted, since a session cookie
+// is as good as the API token.
+func redactHeader(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range []string{"Cookie", "Set-Cookie"} {
+		for i := range redacted[name] {
+			redacted[name][i] = "REDACTED"
+		}
+	}
+	return redacted
+}
+
+// Remove the API token from a URL, leaving the remaining query parameters in a
+// canonical order.
+func stripToken(url string) string {
+	u, err := liburl.Parse(url)
+	if err != nil {
+		return url
+	}
+	query := u.Query()
+	query.Del("api.token")
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Read a request's body, leaving a copy in its place for the next transport.
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tedkornish/scrape-phabricator-macros/conduittest"
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+// Scrape a client's macros into a map of image bodies by name.
+func scrapeImages(t *testing.T, client *scraper.Client) map[string]string {
+	t.Helper()
+	images := make(map[string]string)
+	s := scraper.New(client, scraper.WithConcurrency(1), scraper.OnImage(func(image scraper.Image) error {
+		images[image.Name] = string(image.Body)
+		return nil
+	}))
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	return images
+}
+
+func TestCassetteReplay(t *testing.T) {
+	server := conduittest.NewServer("api-secret")
+	for _, name := range []string{"cat", "party"} {
+		server.AddMacro(conduittest.Macro{Name: name, Data: []byte("GIF89a " + name), AuthorPHID: "PHID-USER-alice"})
+	}
+	dir := t.TempDir()
+
+	recorded := scrapeImages(t, &scraper.Client{
+		Host:  server.URL,
+		Token: "api-secret",
+		HTTP:  &http.Client{Transport: cassetteRecorder{dir: dir, next: http.DefaultTransport}},
+	})
+	server.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("nothing was recorded")
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "api-secret") {
+			t.Errorf("%s contains the API token", filepath.Base(file))
+		}
+	}
+
+	// The server is gone, so everything must come from the cassette, whatever
+	// the key.
+	player := &scraper.Client{Host: server.URL, Token: "replay", HTTP: &http.Client{Transport: cassettePlayer{dir: dir}}}
+	replayed := scrapeImages(t, player)
+	if len(replayed) != len(recorded) {
+		t.Errorf("replayed %d images, recorded %d", len(replayed), len(recorded))
+	}
+	for name, body := range recorded {
+		if replayed[name] != body {
+			t.Errorf("%s replayed as %q, recorded as %q", name, replayed[name], body)
+		}
+	}
+
+	var result interface{}
+	err = player.Call("user.whoami", nil, &result)
+	if err == nil || !strings.Contains(err.Error(), "replay: no recording of GET") ||
+		!strings.Contains(err.Error(), "user.whoami-") || strings.Contains(err.Error(), "token=replay") {
+		t.Errorf("unrecorded call returned %v, want an error naming the missing recording", err)
+	}
+}
+
+func TestCassetteRedactsCookies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "phsid", Value: "session-secret"})
+		w.Write([]byte(`{"result":{"phid":"PHID-USER-alice"},"error_code":null,"error_info":null}`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+
+	client := &scraper.Client{
+		Host:  server.URL,
+		Token: "api-secret",
+		HTTP:  &http.Client{Transport: cassetteRecorder{dir: dir, next: http.DefaultTransport}},
+	}
+	var result struct{ PHID string }
+	if err := client.Call("user.whoami", nil, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "user.whoami-*.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("recorded %v (%v), want one user.whoami exchange", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "session-secret") || !strings.Contains(string(data), "REDACTED") {
+		t.Errorf("recorded cookie wasn't redacted:\n%s", data)
+	}
+}
@@ -0,0 +1,84 @@
+// Command fake-conduit serves a fake Phabricator Conduit API for developing
+// against locally. It serves every image in a directory as a macro named after
+// the file, and prints the URL and token to scrape it with.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tedkornish/scrape-phabricator-macros/conduittest"
+)
+
+func main() {
+	var (
+		dir       = flag.String("dir", ".", "the directory of images to serve as macros")
+		addr      = flag.String("addr", "127.0.0.1:8700", "the address to listen on")
+		token     = flag.String("token", "api-fake", "the API token to accept")
+		latency   = flag.Duration("latency", 0, "how long to delay every response")
+		rateLimit = flag.Int("rateLimit", 0, "the most requests to answer per second, or 0 for no limit")
+		phorge    = flag.Bool("phorge", false, "whether to describe the server as Phorge")
+		legacy    = flag.Bool("legacy", false, "whether to leave out the *.search methods, as older releases do")
+	)
+	flag.Parse()
+
+	server := conduittest.NewUnstartedServer(*token)
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.Listener.Close()
+	server.Listener = listener
+
+	paths, err := filepath.Glob(filepath.Join(*dir, "*"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var served int
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if info.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		server.AddMacro(conduittest.Macro{
+			Name:       name,
+			Data:       data,
+			AuthorPHID: "PHID-USER-alice",
+			Created:    info.ModTime(),
+		})
+		served++
+	}
+
+	server.SetLatency(*latency)
+	server.SetRateLimit(*rateLimit, time.Second)
+	server.SetPhorge(*phorge)
+	if *legacy {
+		for _, method := range []string{"macro.search", "file.search", "user.search"} {
+			server.RemoveMethod(method)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	fmt.Printf("Serving %d macros from %s\n", served, *dir)
+	fmt.Printf("scrape-phabricator-macros -host %s -key %s\n", server.URL, *token)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
@@ -0,0 +1,514 @@
+// Package conduittest provides a fake Phabricator Conduit API for exercising
+// the scraper without a live instance, in tests and during local development.
+//
+// The fake implements the methods the scraper relies on (conduit.ping,
+// conduit.query, conduit.getcapabilities, user.whoami, user.search,
+// phid.lookup, macro.search, macro.query, file.download, file.info and
+// file.search) over an httptest.Server, and can be told to misbehave: to
+// respond slowly, to fail or garble particular methods, to rate limit, or to
+// look like an older release or Phorge.
+package conduittest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Macro is an image macro held by the fake.
+type Macro struct {
+	Name       string
+	Data       []byte
+	AuthorPHID string
+	Created    time.Time
+	// FilePHID identifies the macro's image. It's derived from the name if
+	// left empty; set it to make several macros share one file.
+	FilePHID string
+}
+
+// User is a user account held by the fake.
+type User struct {
+	PHID     string
+	UserName string
+	RealName string
+}
+
+// Server is a fake Conduit API. Its methods are safe for concurrent use, so
+// its behavior can be changed while a scrape is running against it.
+type Server struct {
+	*httptest.Server
+
+	// Token is the API token requests must carry.
+	Token string
+
+	mu         sync.Mutex
+	macros     map[string]Macro // by name
+	users      map[string]User  // by PHID
+	whoami     string           // PHID of the user the token belongs to
+	latency    time.Duration
+	failures   map[string]conduitError
+	malformed  map[string]bool
+	removed    map[string]bool
+	phorge     bool
+	macroList  bool
+	pageSize   int
+	rateLimit  int
+	ratePeriod time.Duration
+	rateWindow time.Time
+	rateCount  int
+	requests   map[string]int
+}
+
+type conduitError struct {
+	code, info string
+}
+
+// NewServer starts a fake Conduit API which accepts the given token and has a
+// single user, "alice", whom the token belongs to. Close it when done.
+func NewServer(token string) *Server {
+	s := NewUnstartedServer(token)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a fake which isn't yet listening, so its Listener
+// can be replaced before calling Start, e.g. to serve on a fixed port.
+func NewUnstartedServer(token string) *Server {
+	s := &Server{
+		Token:     token,
+		macros:    make(map[string]Macro),
+		users:     make(map[string]User),
+		failures:  make(map[string]conduitError),
+		malformed: make(map[string]bool),
+		removed:   make(map[string]bool),
+		requests:  make(map[string]int),
+		pageSize:  100,
+	}
+	s.AddUser(User{PHID: "PHID-USER-alice", UserName: "alice", RealName: "Alice Example"})
+	s.whoami = "PHID-USER-alice"
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// AddMacro adds a macro, filling in its file PHID if it has none, and returns
+// it as stored.
+func (s *Server) AddMacro(m Macro) Macro {
+	if m.FilePHID == "" {
+		sum := sha256.Sum256([]byte(m.Name))
+		m.FilePHID = "PHID-FILE-" + hex.EncodeToString(sum[:])[:20]
+	}
+	if m.Created.IsZero() {
+		m.Created = time.Unix(1500000000, 0)
+	}
+	s.mu.Lock()
+	s.macros[m.Name] = m
+	s.mu.Unlock()
+	return m
+}
+
+// RemoveMacro deletes the named macro.
+func (s *Server) RemoveMacro(name string) {
+	s.mu.Lock()
+	delete(s.macros, name)
+	s.mu.Unlock()
+}
+
+// AddUser adds a user account.
+func (s *Server) AddUser(u User) {
+	s.mu.Lock()
+	s.users[u.PHID] = u
+	s.mu.Unlock()
+}
+
+// SetLatency delays every response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	s.latency = d
+	s.mu.Unlock()
+}
+
+// FailMethod makes every call to method return the given Conduit error.
+func (s *Server) FailMethod(method, code, info string) {
+	s.mu.Lock()
+	s.failures[method] = conduitError{code: code, info: info}
+	s.mu.Unlock()
+}
+
+// MalformMethod makes every call to method return a body that isn't JSON.
+func (s *Server) MalformMethod(method string) {
+	s.mu.Lock()
+	s.malformed[method] = true
+	s.mu.Unlock()
+}
+
+// RemoveMethod makes method unknown to the server, as on an older release:
+// it's left out of conduit.query and calls to it fail with ERR-CONDUIT-CALL.
+func (s *Server) RemoveMethod(method string) {
+	s.mu.Lock()
+	s.removed[method] = true
+	s.mu.Unlock()
+}
+
+// Reset undoes FailMethod, MalformMethod and RemoveMethod for every method.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	s.failures = make(map[string]conduitError)
+	s.malformed = make(map[string]bool)
+	s.removed = make(map[string]bool)
+	s.mu.Unlock()
+}
+
+// SetPhorge makes the server describe itself as Phorge rather than
+// Phabricator.
+func (s *Server) SetPhorge(phorge bool) {
+	s.mu.Lock()
+	s.phorge = phorge
+	s.mu.Unlock()
+}
+
+// SetMacroList makes macro.query return a list of macros, as some releases do,
+// rather than an object keyed by name.
+func (s *Server) SetMacroList(list bool) {
+	s.mu.Lock()
+	s.macroList = list
+	s.mu.Unlock()
+}
+
+// SetPageSize makes the *.search methods return at most n results a page,
+// rather than 100, so clients have to page through them.
+func (s *Server) SetPageSize(n int) {
+	s.mu.Lock()
+	s.pageSize = n
+	s.mu.Unlock()
+}
+
+// SetRateLimit allows at most n requests per period, answering the rest with
+// HTTP 429 and ERR-RATE-LIMIT. A limit of 0 removes it.
+func (s *Server) SetRateLimit(n int, period time.Duration) {
+	s.mu.Lock()
+	s.rateLimit = n
+	s.ratePeriod = period
+	s.rateWindow = time.Time{}
+	s.rateCount = 0
+	s.mu.Unlock()
+}
+
+// Requests returns how many calls have been made to method, including failed
+// ones.
+func (s *Server) Requests(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method]
+}
+
+// The methods every fake server offers, and the handlers that implement them.
+// It's filled in by init because conduit.query lists it.
+var methods map[string]func(*Server, map[string]string) (interface{}, *conduitError)
+
+func init() {
+	methods = map[string]func(*Server, map[string]string) (interface{}, *conduitError){
+		"conduit.ping":            (*Server).ping,
+		"conduit.query":           (*Server).query,
+		"conduit.getcapabilities": (*Server).capabilities,
+		"user.whoami":             (*Server).userWhoami,
+		"user.search":             (*Server).userSearch,
+		"phid.lookup":             (*Server).phidLookup,
+		"macro.search":            (*Server).macroSearch,
+		"macro.query":             (*Server).macroQuery,
+		"file.download":           (*Server).fileDownload,
+		"file.info":               (*Server).fileInfo,
+		"file.search":             (*Server).fileSearch,
+	}
+}
+
+// Methods which can be called without a token.
+var unauthenticated = map[string]bool{
+	"conduit.ping":            true,
+	"conduit.getcapabilities": true,
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	method := strings.TrimPrefix(r.URL.Path, "/api/")
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := make(map[string]string)
+	for key := range r.Form {
+		params[key] = r.Form.Get(key)
+	}
+
+	s.mu.Lock()
+	s.requests[method]++
+	latency := s.latency
+	limited := s.overRateLimit()
+	failure, failing := s.failures[method]
+	malformed := s.malformed[method]
+	handler, known := methods[method]
+	known = known && !s.removed[method]
+	s.mu.Unlock()
+
+	time.Sleep(latency)
+
+	switch {
+	case limited:
+		w.WriteHeader(http.StatusTooManyRequests)
+		writeResult(w, nil, &conduitError{"ERR-RATE-LIMIT", "You are being rate limited."})
+	case malformed:
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"result": {"this isn't": valid JSON`)
+	case !known:
+		writeResult(w, nil, &conduitError{"ERR-CONDUIT-CALL", fmt.Sprintf("Conduit method %q does not exist.", method)})
+	case !unauthenticated[method] && params["api.token"] != s.Token:
+		writeResult(w, nil, &conduitError{"ERR-INVALID-AUTH", "API token is invalid."})
+	case failing:
+		writeResult(w, nil, &failure)
+	default:
+		s.mu.Lock()
+		result, err := handler(s, params)
+		s.mu.Unlock()
+		writeResult(w, result, err)
+	}
+}
+
+// Count a request against the rate limit, reporting whether it's over it.
+// Must be called with s.mu held.
+func (s *Server) overRateLimit() bool {
+	if s.rateLimit <= 0 {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(s.rateWindow) >= s.ratePeriod {
+		s.rateWindow = now
+		s.rateCount = 0
+	}
+	s.rateCount++
+	return s.rateCount > s.rateLimit
+}
+
+func writeResult(w http.ResponseWriter, result interface{}, err *conduitError) {
+	body := map[string]interface{}{"result": result, "error_code": nil, "error_info": nil}
+	if err != nil {
+		body["error_code"] = err.code
+		body["error_info"] = err.info
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// The handlers below are called with s.mu held.
+
+func (s *Server) ping(map[string]string) (interface{}, *conduitError) {
+	return "conduittest", nil
+}
+
+func (s *Server) query(map[string]string) (interface{}, *conduitError) {
+	product := "Phabricator"
+	if s.phorge {
+		product = "Phorge"
+	}
+	result := make(map[string]interface{})
+	for method := range methods {
+		if !s.removed[method] {
+			result[method] = map[string]interface{}{
+				"description": fmt.Sprintf("Implements %s for %s.", method, product),
+				"params":      map[string]string{},
+				"return":      "wild",
+			}
+		}
+	}
+	return result, nil
+}
+
+func (s *Server) capabilities(map[string]string) (interface{}, *conduitError) {
+	return map[string][]string{
+		"authentication": {"token", "asymmetric", "session", "sessionless"},
+		"signatures":     {"consign"},
+		"input":          {"json", "urlencoded"},
+		"output":         {"json", "human"},
+	}, nil
+}
+
+func (s *Server) userWhoami(map[string]string) (interface{}, *conduitError) {
+	u := s.users[s.whoami]
+	return map[string]string{"phid": u.PHID, "userName": u.UserName, "realName": u.RealName}, nil
+}
+
+func (s *Server) userSearch(params map[string]string) (interface{}, *conduitError) {
+	var data []interface{}
+	for _, phid := range indexedParams(params, "constraints[phids]") {
+		if u, ok := s.users[phid]; ok {
+			data = append(data, searchResult(u.PHID, "USER", map[string]interface{}{
+				"username": u.UserName,
+				"realName": u.RealName,
+			}))
+		}
+	}
+	return s.searchResults(data, params)
+}
+
+func (s *Server) phidLookup(params map[string]string) (interface{}, *conduitError) {
+	result := make(map[string]interface{})
+	for _, name := range indexedParams(params, "names") {
+		if u, ok := s.users[name]; ok {
+			result[name] = map[string]string{
+				"phid":     u.PHID,
+				"type":     "USER",
+				"name":     u.UserName,
+				"fullName": u.UserName + " (" + u.RealName + ")",
+				"status":   "open",
+			}
+		}
+	}
+	return result, nil
+}
+
+func (s *Server) macroSearch(params map[string]string) (interface{}, *conduitError) {
+	var data []interface{}
+	for i, name := range s.macroNames() {
+		m := s.macros[name]
+		sum := sha256.Sum256([]byte("macro " + m.Name))
+		result := searchResult("PHID-MCRO-"+hex.EncodeToString(sum[:])[:20], "MCRO", map[string]interface{}{
+			"name":         m.Name,
+			"filePHID":     m.FilePHID,
+			"authorPHID":   m.AuthorPHID,
+			"dateCreated":  m.Created.Unix(),
+			"dateModified": m.Created.Unix(),
+			"policy":       map[string]string{"view": "users", "edit": "users"},
+		})
+		result["id"] = i + 1
+		data = append(data, result)
+	}
+	return s.searchResults(data, params)
+}
+
+func (s *Server) macroQuery(map[string]string) (interface{}, *conduitError) {
+	byName := make(map[string]interface{})
+	var list []interface{}
+	for _, name := range s.macroNames() {
+		m := s.macros[name]
+		fields := map[string]interface{}{
+			"name":        m.Name,
+			"uri":         s.URL + "/macro/view/" + m.Name + "/",
+			"filePHID":    m.FilePHID,
+			"authorPHID":  m.AuthorPHID,
+			"dateCreated": strconv.FormatInt(m.Created.Unix(), 10),
+			"status":      "active",
+		}
+		byName[name] = fields
+		list = append(list, fields)
+	}
+	if s.macroList {
+		return list, nil
+	}
+	return byName, nil
+}
+
+func (s *Server) fileDownload(params map[string]string) (interface{}, *conduitError) {
+	m, ok := s.macroByFile(params["phid"])
+	if !ok {
+		return nil, &conduitError{"ERR-BAD-PHID", "No such file exists."}
+	}
+	return base64.StdEncoding.EncodeToString(m.Data), nil
+}
+
+func (s *Server) fileInfo(params map[string]string) (interface{}, *conduitError) {
+	m, ok := s.macroByFile(params["phid"])
+	if !ok {
+		return nil, &conduitError{"ERR-NOT-FOUND", "No such file exists."}
+	}
+	return map[string]string{
+		"phid":         m.FilePHID,
+		"name":         m.Name,
+		"mimeType":     http.DetectContentType(m.Data),
+		"byteSize":     strconv.Itoa(len(m.Data)),
+		"authorPHID":   m.AuthorPHID,
+		"dateCreated":  strconv.FormatInt(m.Created.Unix(), 10),
+		"dateModified": strconv.FormatInt(m.Created.Unix(), 10),
+	}, nil
+}
+
+func (s *Server) fileSearch(params map[string]string) (interface{}, *conduitError) {
+	var data []interface{}
+	for _, phid := range indexedParams(params, "constraints[phids]") {
+		if m, ok := s.macroByFile(phid); ok {
+			data = append(data, searchResult(m.FilePHID, "FILE", map[string]interface{}{
+				"name":         m.Name,
+				"size":         len(m.Data),
+				"dateCreated":  m.Created.Unix(),
+				"dateModified": m.Created.Unix(),
+			}))
+		}
+	}
+	return s.searchResults(data, params)
+}
+
+func (s *Server) macroNames() []string {
+	var names []string
+	for name := range s.macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) macroByFile(phid string) (Macro, bool) {
+	for _, name := range s.macroNames() {
+		if s.macros[name].FilePHID == phid {
+			return s.macros[name], true
+		}
+	}
+	return Macro{}, false
+}
+
+// Collect the values of params such as "names[0]", "names[1]" in order.
+func indexedParams(params map[string]string, prefix string) []string {
+	var values []string
+	for i := 0; ; i++ {
+		value, ok := params[fmt.Sprintf("%s[%d]", prefix, i)]
+		if !ok {
+			return values
+		}
+		values = append(values, value)
+	}
+}
+
+func searchResult(phid, kind string, fields map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"phid": phid, "type": kind, "fields": fields}
+}
+
+// Return the page of a search's results that params ask for. The cursor is
+// the number of results on earlier pages, which clients needn't know.
+func (s *Server) searchResults(data []interface{}, params map[string]string) (interface{}, *conduitError) {
+	start := 0
+	if after := params["after"]; after != "" {
+		n, err := strconv.Atoi(after)
+		if err != nil || n < 0 || n > len(data) {
+			return nil, &conduitError{"ERR-CONDUIT-CORE", "Invalid cursor."}
+		}
+		start = n
+	}
+	end := start + s.pageSize
+	if end > len(data) {
+		end = len(data)
+	}
+
+	var after interface{}
+	if end < len(data) {
+		after = strconv.Itoa(end)
+	}
+	page := append([]interface{}{}, data[start:end]...)
+	return map[string]interface{}{
+		"data":   page,
+		"cursor": map[string]interface{}{"limit": s.pageSize, "after": after, "before": nil},
+	}, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+// sizeLimits caps how much a run may write. Zero means no limit.
+type sizeLimits struct {
+	maxFileBytes  int64
+	maxTotalBytes int64
+}
+
+// Explain why an image of the given size can't be written, if it can't.
+func (l sizeLimits) checkFile(size int64) error {
+	if l.maxFileBytes > 0 && size > l.maxFileBytes {
+		return fmt.Errorf(
+			"%s exceeds -maxFileBytes of %s",
+			formatBytes(size),
+			formatBytes(l.maxFileBytes),
+		)
+	}
+	return nil
+}
+
+// Split macros into those within -maxFileBytes and those over it, as far as
+// their known sizes tell, and total up the known sizes of those within it.
+func (l sizeLimits) partition(macros []scraper.Macro) (within, over []scraper.Macro, estimate int64, unknown int) {
+	for _, m := range macros {
+		if l.checkFile(m.Size) != nil {
+			over = append(over, m)
+			continue
+		}
+		within = append(within, m)
+		estimate += m.Size
+		if m.Size == 0 {
+			unknown++
+		}
+	}
+	return within, over, estimate, unknown
+}
+
+// Check that an estimated scrape fits within -maxTotalBytes and the free space
+// left in dir, if the images are being written to one.
+func (l sizeLimits) checkEstimate(dir string, estimate int64) error {
+	if l.maxTotalBytes > 0 && estimate > l.maxTotalBytes {
+		return fmt.Errorf(
+			"an estimated %s of images exceeds -maxTotalBytes of %s",
+			formatBytes(estimate),
+			formatBytes(l.maxTotalBytes),
+		)
+	}
+	if dir == "" {
+		return nil
+	}
+
+	// The directory may not have been created yet, in which case the free
+	// space is that of its nearest existing parent.
+	for {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	free, known, err := freeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("failed to determine free space in %s: %v", dir, err)
+	}
+	if known && uint64(estimate) > free {
+		return fmt.Errorf(
+			"an estimated %s of images won't fit in the %s free in %s",
+			formatBytes(estimate),
+			formatBytes(int64(free)),
+			dir,
+		)
+	}
+	return nil
+}
+
+// budget tracks the bytes written across every instance in a run, so that
+// -maxTotalBytes holds even when sizes couldn't be estimated up front.
+type budget struct {
+	mu      sync.Mutex
+	limits  sizeLimits
+	written int64
+}
+
+// Account for an image about to be written, or explain why it can't be.
+func (b *budget) reserve(size int64) error {
+	if err := b.limits.checkFile(size); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limits.maxTotalBytes > 0 && b.written+size > b.limits.maxTotalBytes {
+		return fmt.Errorf(
+			"writing %s would exceed -maxTotalBytes of %s",
+			formatBytes(size),
+			formatBytes(b.limits.maxTotalBytes),
+		)
+	}
+	b.written += size
+	return nil
+}
+
+// Format a number of bytes for humans, e.g. "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+// The actions a scrape can take for a macro.
+const (
+	actionDownload  = "download"  // the image isn't in the output directory yet
+	actionOverwrite = "overwrite" // the image is already there and would be replaced
+	actionSkip      = "skip"      // the image won't be fetched at all
+	actionDelete    = "delete"    // the macro is gone, so its committed image would be removed
+)
+
+// plannedAction is what a scrape would do with a single macro, and why.
+type plannedAction struct {
+	action string
+	macro  scraper.Macro
+	reason string // for skips
+}
+
+// Work out what scraping an instance would do, without downloading any images
+// or touching the filesystem beyond reading it. The macros are listed by the
+// same scraper a real scrape would use, so the two can't disagree.
+func planInstance(inst instance, config config) ([]plannedAction, error) {
+	listed, macros, err := newScraper(inst, config).List()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		plan     []plannedAction
+		selected = make(map[string]bool)
+	)
+	for _, m := range macros {
+		selected[m.Name] = true
+
+		if err := config.limits.checkFile(m.Size); err != nil {
+			plan = append(plan, plannedAction{action: actionSkip, macro: m, reason: err.Error()})
+		} else if name, err := config.layout.Name(m, nil); err != nil {
+			return nil, err
+		} else if exists, err := inst.sink.Exists(name); err != nil {
+			return nil, err
+		} else if exists {
+			plan = append(plan, plannedAction{action: actionOverwrite, macro: m})
+		} else {
+			plan = append(plan, plannedAction{action: actionDownload, macro: m})
+		}
+	}
+	for _, m := range listed {
+		if !selected[m.Name] {
+			plan = append(plan, plannedAction{action: actionSkip, macro: m, reason: "excluded by filters"})
+		}
+	}
+
+	// Committing a scrape removes the macros the last one committed that are
+	// no longer selected.
+	if config.git != nil {
+		prev, err := readManifestFile(inst.dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read previous manifest: %v", err)
+		}
+		for _, entry := range prev.Macros {
+			if !selected[entry.Name] {
+				plan = append(plan, plannedAction{action: actionDelete, macro: scraper.Macro{Name: entry.Name}})
+			}
+		}
+	}
+
+	sort.Slice(plan, func(i, j int) bool { return plan[i].macro.Name < plan[j].macro.Name })
+	return plan, nil
+}
+
+// Print a plan one action per line, followed by the counts of each action and
+// the estimated number of bytes that would be written, and whether that would
+// fit within the limits and free space.
+func printPlan(w io.Writer, inst instance, config config, plan []plannedAction) {
+	var (
+		counts   = make(map[string]int)
+		estimate int64
+		unknown  int
+	)
+
+	fmt.Fprintf(w, "Planned actions for %s:\n", inst.client.Host)
+	for _, p := range plan {
+		counts[p.action]++
+		size := "unknown size"
+		if p.macro.Size > 0 {
+			size = formatBytes(p.macro.Size)
+		}
+
+		switch p.action {
+		case actionDelete:
+			fmt.Fprintf(w, "  %-9s  %s\n", p.action, p.macro.Name)
+		case actionSkip:
+			fmt.Fprintf(w, "  %-9s  %s (%s)\n", p.action, p.macro.Name, p.reason)
+		default:
+			fmt.Fprintf(w, "  %-9s  %s (%s%s)\n", p.action, p.macro.Name, size, describeAuthor(p.macro))
+			estimate += p.macro.Size
+			if p.macro.Size == 0 {
+				unknown++
+			}
+		}
+	}
+
+	fmt.Fprintf(w,
+		"%d to download, %d to overwrite, %d to skip, %d to delete; an estimated %s to write",
+		counts[actionDownload],
+		counts[actionOverwrite],
+		counts[actionSkip],
+		counts[actionDelete],
+		formatBytes(estimate),
+	)
+	if unknown > 0 {
+		fmt.Fprintf(w, " plus %d images of unknown size", unknown)
+	}
+	fmt.Fprintln(w, ".")
+
+	if err := config.limits.checkEstimate(inst.dir, estimate); err != nil {
+		fmt.Fprintf(w, "The scrape wouldn't start: %v.\n", err)
+	}
+}
+
+// Describe who created a macro for a plan, e.g. ", by alice (Alice Liddell)",
+// or nothing if they couldn't be looked up.
+func describeAuthor(m scraper.Macro) string {
+	switch {
+	case m.AuthorName == "":
+		return ""
+	case m.AuthorRealName == "":
+		return ", by " + m.AuthorName
+	}
+	return fmt.Sprintf(", by %s (%s)", m.AuthorName, m.AuthorRealName)
+}
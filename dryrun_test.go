@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tedkornish/scrape-phabricator-macros/conduittest"
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+func TestDryRunWritesNothing(t *testing.T) {
+	server := conduittest.NewServer("api-test")
+	defer server.Close()
+	server.AddUser(conduittest.User{PHID: "PHID-USER-alice", UserName: "alice", RealName: "Alice Liddell"})
+	for _, name := range []string{"cat", "party", "shrug"} {
+		server.AddMacro(conduittest.Macro{Name: name, Data: []byte("GIF89a " + name), AuthorPHID: "PHID-USER-alice"})
+	}
+
+	// The output directory already holds one image, and everything else the
+	// run could write goes alongside it.
+	root := t.TempDir()
+	dir := filepath.Join(root, "out")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cat.gif"), []byte("GIF89a cat"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := scraper.LoadUserCache(filepath.Join(root, "cache", "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace := newHARRecorder(http.DefaultTransport)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	inst := instance{
+		client: &scraper.Client{
+			Host:   server.URL,
+			Token:  "api-test",
+			HTTP:   &http.Client{Transport: trace},
+			Logger: logger,
+		},
+		sink: scraper.NewDirSink(dir),
+		dir:  dir,
+	}
+	layout, err := scraper.ParseLayout(scraper.DefaultLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	config := config{
+		instances:            []instance{inst},
+		numConcurrentFetches: 4,
+		dryRun:               true,
+		layout:               layout,
+		users:                users,
+		log:                  logger,
+		metrics:              newMetrics(),
+		metricsFile:          filepath.Join(root, "metrics.prom"),
+		trace:                trace,
+		tracePath:            filepath.Join(root, "trace.har"),
+		out:                  &out,
+	}
+	state := &runState{
+		errors:  makeErrorSet(),
+		skipped: makeErrorSet(),
+		started: time.Now(),
+	}
+
+	if !printChecks(&out, inst.client.Host, preflight(inst, true, false)) {
+		t.Fatalf("pre-flight checks failed:\n%s", out.String())
+	}
+	plan, err := planInstance(inst, config)
+	if err != nil {
+		t.Fatalf("planInstance: %v", err)
+	}
+	printPlan(&out, inst, config, plan)
+	finishRun(config, state)
+
+	if !strings.Contains(out.String(), "2 to download, 1 to overwrite, 0 to skip, 0 to delete") {
+		t.Errorf("plan doesn't count the actions expected:\n%s", out.String())
+	}
+	if got := server.Requests("file.download"); got != 0 {
+		t.Errorf("dry run downloaded %d images", got)
+	}
+
+	var files []string
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != filepath.Join(dir, "cat.gif") {
+		t.Errorf("dry run left %v behind, want only the existing cat.gif", files)
+	}
+}
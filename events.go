@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// The version of the event schema below. It's incremented whenever a field is
+// removed or its meaning changes; adding fields or event types doesn't.
+const eventSchemaVersion = 1
+
+// The types of event in the stream.
+const (
+	eventListingStarted   = "listing.started"
+	eventListingCompleted = "listing.completed"
+	eventMacroQueued      = "macro.queued"
+	eventMacroDownloaded  = "macro.downloaded"
+	eventMacroWritten     = "macro.written"
+	eventMacroSkipped     = "macro.skipped"
+	eventMacroFailed      = "macro.failed"
+	eventRunSummary       = "run.summary"
+)
+
+// event is a single line of the -events=ndjson stream. See the README for
+// which fields each type of event carries.
+type event struct {
+	Schema   int         `json:"schema"`
+	Type     string      `json:"type"`
+	Time     time.Time   `json:"time"`
+	Host     string      `json:"host,omitempty"`
+	Macro    string      `json:"macro,omitempty"`
+	Path     string      `json:"path,omitempty"`
+	Bytes    int64       `json:"bytes,omitempty"`
+	Listed   *int        `json:"listed,omitempty"`
+	Selected *int        `json:"selected,omitempty"`
+	Reason   string      `json:"reason,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Summary  *runSummary `json:"summary,omitempty"`
+}
+
+// runSummary totals up the outcome of a run.
+type runSummary struct {
+	Instances       int     `json:"instances"`
+	FailedInstances int     `json:"failedInstances"`
+	Queued          int     `json:"queued"`
+	Written         int     `json:"written"`
+	Skipped         int     `json:"skipped"`
+	Failed          int     `json:"failed"`
+	Bytes           int64   `json:"bytes"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// eventStream writes events as newline-delimited JSON. A nil stream discards
+// them, so callers needn't check whether events were asked for.
+type eventStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newEventStream(w io.Writer) *eventStream {
+	return &eventStream{enc: json.NewEncoder(w)}
+}
+
+func (s *eventStream) emit(e event) {
+	if s == nil {
+		return
+	}
+	e.Schema = eventSchemaVersion
+	e.Time = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enc.Encode(e)
+}
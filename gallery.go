@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"os"
+	"path"
+	"time"
+
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+// The gallery command builds a static site for browsing the macros a scrape
+// mirrored, without access to Phabricator: one page, with everything it needs
+// inline, and a copy of each distinct image named after its SHA-256.
+func runGallery(args []string) error {
+	flags := flag.NewFlagSet("gallery", flag.ExitOnError)
+	dir := flags.String("dir", "", "the output directory of a scrape")
+	out := flags.String("out", "", "the directory to write the gallery into")
+	title := flags.String("title", "Macros", "the title of the gallery page")
+	flags.Parse(args)
+
+	if *dir == "" || *out == "" {
+		return errors.New("please specify the scrape's -dir and the gallery's -out directory")
+	}
+	mirror, err := readMirror(*dir)
+	if err != nil {
+		return err
+	}
+
+	page := galleryPage{Title: *title, Generated: time.Now().UTC(), Multiple: len(mirror) > 1}
+	site := scraper.NewDirSink(*out, scraper.WithFileMode(0644), scraper.WithMkdir(0755))
+	if err := site.Open(); err != nil {
+		return err
+	}
+	images := make(map[string]bool)
+	for _, inst := range mirror {
+		for _, entry := range inst.manifest.Macros {
+			src, err := inst.imagePath(entry)
+			if err != nil {
+				return err
+			}
+			// Images are named by content, so each is only copied once however
+			// many macros share it, and not again when the gallery's rebuilt.
+			name := path.Join(galleryImages, entry.SHA256+path.Ext(entry.Path))
+			if !images[name] {
+				if err := copyNew(site, src, name); err != nil {
+					return fmt.Errorf("failed to copy %s: %v", entry.Name, err)
+				}
+				images[name] = true
+			}
+			page.Macros = append(page.Macros, galleryMacro{
+				Name:       entry.Name,
+				Image:      name,
+				Author:     entry.Author,
+				AuthorName: entry.AuthorName,
+				Created:    entry.Created,
+				Host:       inst.manifest.Host,
+			})
+		}
+	}
+
+	var b bytes.Buffer
+	if err := galleryTemplate.Execute(&b, page); err != nil {
+		return err
+	}
+	if err := scraper.WriteObject(site, "index.html", b.Bytes()); err != nil {
+		return err
+	}
+
+	// Only once the page no longer refers to them can old images go.
+	pruned, err := pruneImages(site, images)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote a gallery of %d macros to %s\n", len(page.Macros), site.Path("index.html"))
+	if pruned > 0 {
+		fmt.Printf("Removed %d images no longer in it\n", pruned)
+	}
+	return nil
+}
+
+// Where in the site the images are copied to.
+const galleryImages = "images"
+
+type galleryPage struct {
+	Title     string
+	Generated time.Time
+	Multiple  bool // whether to show which instance each macro is from
+	Macros    []galleryMacro
+}
+
+type galleryMacro struct {
+	Name               string
+	Image              string // relative to the page
+	Author, AuthorName string
+	Created            time.Time
+	Host               string
+}
+
+// Copy a file into the site unless it's already there.
+func copyNew(site *scraper.DirSink, src, name string) error {
+	if exists, err := site.Exists(name); err != nil || exists {
+		return err
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return scraper.WriteObject(site, name, data)
+}
+
+// Delete the images no macro in the gallery has any more, returning how many
+// there were.
+func pruneImages(site *scraper.DirSink, keep map[string]bool) (int, error) {
+	entries, err := os.ReadDir(site.Path(galleryImages))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var pruned int
+	for _, entry := range entries {
+		name := path.Join(galleryImages, entry.Name())
+		if entry.Type().IsRegular() && !keep[name] {
+			if err := site.Delete(name); err != nil {
+				return pruned, err
+			}
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// The page works without JavaScript, which only adds searching and copying.
+var galleryTemplate = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 0; background: #f5f6f8; color: #222; }
+header { position: sticky; top: 0; z-index: 1; display: flex; flex-wrap: wrap; gap: 1em; align-items: center; padding: 1em 1.5em; background: #fff; box-shadow: 0 1px 3px rgba(0, 0, 0, .1); }
+h1 { font-size: 1.25em; margin: 0; }
+input[type=search] { flex: 1; min-width: 12em; max-width: 30em; padding: .5em .75em; font-size: 1em; border: 1px solid #ccc; border-radius: 4px; }
+#count { color: #666; }
+main { display: grid; grid-template-columns: repeat(auto-fill, minmax(200px, 1fr)); gap: 1em; padding: 1.5em; }
+figure { margin: 0; display: flex; flex-direction: column; background: #fff; border-radius: 6px; box-shadow: 0 1px 3px rgba(0, 0, 0, .1); overflow: hidden; }
+figure[hidden] { display: none; }
+.image { display: flex; align-items: center; justify-content: center; height: 180px; background: #eee; }
+.image img { max-width: 100%; max-height: 180px; }
+figcaption { padding: .5em .75em .75em; font-size: .875em; }
+.name { font-weight: bold; word-break: break-all; }
+.meta { color: #666; margin: .25em 0 .5em; }
+.snippet { display: flex; gap: .5em; align-items: center; }
+code { flex: 1; padding: .2em .4em; background: #f0f0f0; border-radius: 3px; word-break: break-all; user-select: all; }
+button { padding: .2em .6em; font: inherit; border: 1px solid #ccc; border-radius: 3px; background: #fff; cursor: pointer; }
+footer { padding: 0 1.5em 1.5em; color: #888; font-size: .8em; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Title}}</h1>
+<input type="search" id="search" placeholder="Search by name or author" autofocus>
+<span id="count">{{len .Macros}} macros</span>
+</header>
+<main>
+{{- range .Macros}}
+<figure data-search="{{.Name}} {{.Author}} {{.AuthorName}}">
+<a class="image" href="{{.Image}}"><img src="{{.Image}}" alt="{{.Name}}" loading="lazy"></a>
+<figcaption>
+<div class="name">{{.Name}}</div>
+<div class="meta">
+{{- if .Author}}<span title="{{.AuthorName}}">{{.Author}}</span>, {{end -}}
+<time datetime="{{.Created.Format "2006-01-02T15:04:05Z07:00"}}">{{.Created.Format "2006-01-02"}}</time>
+{{- if $.Multiple}}<br>{{.Host}}{{end -}}
+</div>
+<div class="snippet"><code>{{"{"}}{{.Name}}{{"}"}}</code><button type="button" hidden>Copy</button></div>
+</figcaption>
+</figure>
+{{- end}}
+</main>
+<footer>Generated {{.Generated.Format "2006-01-02 15:04 MST"}}</footer>
+<script>
+(function () {
+  var figures = Array.prototype.slice.call(document.querySelectorAll("figure"));
+  var count = document.getElementById("count");
+  figures.forEach(function (figure) {
+    figure.dataset.search = figure.dataset.search.toLowerCase();
+  });
+  document.getElementById("search").addEventListener("input", function (e) {
+    var terms = e.target.value.toLowerCase().split(/\s+/).filter(Boolean);
+    var shown = 0;
+    figures.forEach(function (figure) {
+      var match = terms.every(function (term) { return figure.dataset.search.indexOf(term) >= 0; });
+      figure.hidden = !match;
+      if (match) shown++;
+    });
+    count.textContent = shown + " macros";
+  });
+
+  function copy(text) {
+    if (navigator.clipboard && window.isSecureContext) {
+      return navigator.clipboard.writeText(text);
+    }
+    var area = document.createElement("textarea");
+    area.value = text;
+    document.body.appendChild(area);
+    area.select();
+    document.execCommand("copy");
+    document.body.removeChild(area);
+    return Promise.resolve();
+  }
+  document.querySelectorAll(".snippet button").forEach(function (button) {
+    button.hidden = false;
+    button.addEventListener("click", function () {
+      copy(button.previousElementSibling.textContent).then(function () {
+        button.textContent = "Copied";
+        setTimeout(function () { button.textContent = "Copy"; }, 1500);
+      });
+    });
+  });
+})();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The name a gallery copies an image to.
+func galleryImageName(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:]) + ".gif"
+}
+
+func TestGallery(t *testing.T) {
+	dir, out := t.TempDir(), t.TempDir()
+	writeMirror(t, filepath.Join(dir, "phab.example.com"), "https://phab.example.com", map[string]string{
+		"party": "GIF89a party",
+		"shrug": "GIF89a shrug",
+	})
+	// The same image on another instance is only copied once.
+	writeMirror(t, filepath.Join(dir, "phorge.example.com"), "https://phorge.example.com", map[string]string{
+		"partytime": "GIF89a party",
+	})
+
+	if err := runGallery([]string{"-dir", dir, "-out", out, "-title", "Our <macros>"}); err != nil {
+		t.Fatalf("gallery: %v", err)
+	}
+
+	page, err := os.ReadFile(filepath.Join(out, "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Our &lt;macros&gt;",
+		"party", "shrug", "partytime",
+		"images/" + galleryImageName("GIF89a party"),
+		"https://phorge.example.com",
+	} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("index.html doesn't contain %q", want)
+		}
+	}
+	images, err := os.ReadDir(filepath.Join(out, "images"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Errorf("copied %d images, want one per distinct image", len(images))
+	}
+
+	// Rebuilding once shrug is gone removes its image.
+	writeMirror(t, filepath.Join(dir, "phab.example.com"), "https://phab.example.com", map[string]string{
+		"party": "GIF89a party",
+	})
+	if err := os.Remove(filepath.Join(dir, "phab.example.com", "shrug.gif")); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGallery([]string{"-dir", dir, "-out", out}); err != nil {
+		t.Fatalf("rebuilding gallery: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "images", galleryImageName("GIF89a shrug"))); !os.IsNotExist(err) {
+		t.Errorf("shrug's image is still in the gallery: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "images", galleryImageName("GIF89a party"))); err != nil {
+		t.Errorf("party's image is gone: %v", err)
+	}
+}
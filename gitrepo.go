@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+// gitRepo is a local git working tree that scrapes are committed to, so the
+// history of the macro collection can be browsed with git.
+type gitRepo struct {
+	dir string
+	// Whether git has no identity to commit as, so commits are made as
+	// defaultIdentity instead.
+	anonymous bool
+	mu        sync.Mutex // git can't run two commands that write to a repo at once
+}
+
+// Run a git command in the repository, returning its trimmed stdout.
+func (r *gitRepo) git(env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", r.dir}, args...)...)
+	cmd.Env = append(os.Environ(), env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Check that the directory is a git working tree.
+func (r *gitRepo) check() error {
+	out, err := r.git(nil, "rev-parse", "--is-inside-work-tree")
+	if err != nil {
+		return fmt.Errorf("%s isn't a git repository: %v", r.dir, err)
+	} else if out != "true" {
+		return fmt.Errorf("%s isn't a git working tree", r.dir)
+	}
+
+	// A fresh machine or CI runner often has no user.name or user.email, and
+	// git refuses to commit without them.
+	if _, err := r.git(nil, "var", "GIT_COMMITTER_IDENT"); err != nil {
+		r.anonymous = true
+	}
+	return nil
+}
+
+// The name commits are made under when git has no identity configured, with
+// a placeholder email address.
+const defaultIdentity = "scrape-phabricator-macros"
+
+// The domain of the placeholder email addresses commits are attributed to. The
+// .invalid TLD is reserved, so they can never reach a real mailbox.
+const noReplyDomain = "users.noreply.invalid"
+
+// snapshot is how a scrape changed an instance's macros since the last one
+// committed.
+type snapshot struct {
+	added, changed, removed []scraper.ManifestEntry
+}
+
+func (s snapshot) empty() bool {
+	return len(s.added)+len(s.changed)+len(s.removed) == 0
+}
+
+// Read the manifest of the last scrape into a directory, if there was one.
+func readManifestFile(dir string) (*scraper.Manifest, error) {
+	f, err := os.Open(filepath.Join(dir, scraper.ManifestName))
+	if os.IsNotExist(err) {
+		return &scraper.Manifest{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return scraper.ReadManifest(f)
+}
+
+// Work out what changed between the previous manifest and the one just
+// written. Macros that were selected but not written this time, because they
+// failed or were skipped, keep their previous entries; those that weren't
+// selected at all are reported as removed.
+func diffManifests(prev, next *scraper.Manifest, selected map[string]bool) snapshot {
+	var (
+		changes  snapshot
+		previous = make(map[string]scraper.ManifestEntry)
+		written  = make(map[string]bool)
+	)
+	for _, entry := range prev.Macros {
+		previous[entry.Name] = entry
+	}
+	for _, entry := range next.Macros {
+		written[entry.Name] = true
+		if old, ok := previous[entry.Name]; !ok {
+			changes.added = append(changes.added, entry)
+		} else if old.SHA256 != entry.SHA256 || old.Path != entry.Path {
+			changes.changed = append(changes.changed, entry)
+		}
+	}
+	for _, entry := range prev.Macros {
+		switch {
+		case written[entry.Name]:
+		case selected[entry.Name]:
+			next.Macros = append(next.Macros, entry)
+		default:
+			changes.removed = append(changes.removed, entry)
+		}
+	}
+	return changes
+}
+
+// Bring an instance's directory up to date with the scrape just run, and
+// commit it. Removed macros' images are deleted, as are the old images of
+// macros the layout now puts elsewhere, and the manifest is rewritten to keep
+// the entries of macros that weren't written this time.
+func (r *gitRepo) commitScrape(
+	inst instance,
+	prev, next *scraper.Manifest,
+	selected map[string]bool,
+) (snapshot, error) {
+	changes := diffManifests(prev, next, selected)
+
+	// The scrape has rewritten the manifest, which would only differ in when
+	// it was generated, so put the previous one back rather than leave the
+	// working tree dirty.
+	if changes.empty() {
+		if prev.Version == 0 {
+			return changes, inst.sink.Delete(scraper.ManifestName)
+		}
+		return changes, prev.Write(inst.sink)
+	}
+
+	paths := make(map[string]bool)
+	for _, entry := range next.Macros {
+		paths[entry.Path] = true
+	}
+	for _, entry := range prev.Macros {
+		if entry.Path != entry.Blob && !paths[entry.Path] {
+			if err := inst.sink.Delete(entry.Path); err != nil {
+				return changes, err
+			}
+		}
+	}
+
+	// With -dedupe, blobs are deleted once no macro's image is in them, as
+	// happens when a macro is removed or changed, unless another macro shares
+	// them.
+	referenced := make(map[string]bool)
+	for _, entry := range next.Macros {
+		referenced[entry.Blob] = true
+	}
+	for _, entry := range prev.Macros {
+		if entry.Blob != "" && !referenced[entry.Blob] {
+			if err := inst.sink.Delete(entry.Blob); err != nil {
+				return changes, err
+			}
+			referenced[entry.Blob] = true // so it's only deleted once
+		}
+	}
+	if err := next.Write(inst.sink); err != nil {
+		return changes, fmt.Errorf("failed to write manifest: %v", err)
+	}
+
+	// Pathspecs are relative to the repository, which inst.dir may not be.
+	pathspec, err := filepath.Rel(r.dir, inst.dir)
+	if err != nil {
+		return changes, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.git(nil, "add", "--all", "--", pathspec); err != nil {
+		return changes, err
+	}
+	subject, body := commitMessage(inst.client.Host, changes)
+	args := []string{"commit", "--quiet", "-m", subject, "-m", body}
+	var env []string
+	if r.anonymous {
+		env = append(env,
+			"GIT_AUTHOR_NAME="+defaultIdentity,
+			"GIT_AUTHOR_EMAIL="+defaultIdentity+"@"+noReplyDomain,
+			"GIT_COMMITTER_NAME="+defaultIdentity,
+			"GIT_COMMITTER_EMAIL="+defaultIdentity+"@"+noReplyDomain,
+		)
+	}
+	if author, date, ok := commitAuthor(changes); ok {
+		args = append(args, "--author="+author)
+		env = append(env, "GIT_AUTHOR_DATE="+date.Format(time.RFC3339))
+	}
+	_, err = r.git(env, append(args, "--", pathspec)...)
+	return changes, err
+}
+
+// Summarize the changes, e.g. "Add 2 and remove 1 macros from
+// phab.example.com", followed by the names of the macros in each group.
+func commitMessage(host string, changes snapshot) (subject, body string) {
+	var counts, sections []string
+	for _, group := range []struct {
+		verb, heading string
+		entries       []scraper.ManifestEntry
+	}{
+		{"add", "Added", changes.added},
+		{"change", "Changed", changes.changed},
+		{"remove", "Removed", changes.removed},
+	} {
+		if len(group.entries) == 0 {
+			continue
+		}
+		counts = append(counts, fmt.Sprintf("%s %d", group.verb, len(group.entries)))
+		names := make([]string, len(group.entries))
+		for i, entry := range group.entries {
+			names[i] = entry.Name
+		}
+		sort.Strings(names)
+		sections = append(sections, group.heading+": "+strings.Join(names, ", "))
+	}
+
+	summary := strings.Join(counts, ", ")
+	if i := strings.LastIndex(summary, ", "); i >= 0 {
+		summary = summary[:i] + " and " + summary[i+2:]
+	}
+	noun := "macros"
+	if len(changes.added)+len(changes.changed)+len(changes.removed) == 1 {
+		noun = "macro"
+	}
+	subject = fmt.Sprintf("%s %s from %s", strings.ToUpper(summary[:1])+summary[1:], noun, host)
+	return subject, strings.Join(sections, "\n")
+}
+
+// A commit can be attributed to the macros' author when they were all added or
+// changed by the same person, and dated when the newest of them was created.
+// Conduit doesn't tell us other users' email addresses, so the author's is a
+// placeholder that can't be delivered to, e.g. alice@users.noreply.invalid.
+func commitAuthor(changes snapshot) (author string, date time.Time, ok bool) {
+	var last scraper.ManifestEntry
+	for _, entry := range append(append([]scraper.ManifestEntry{}, changes.added...), changes.changed...) {
+		if entry.AuthorPHID == "" || (last.AuthorPHID != "" && entry.AuthorPHID != last.AuthorPHID) {
+			return "", time.Time{}, false
+		}
+		last = entry
+		if entry.Created.After(date) {
+			date = entry.Created
+		}
+	}
+	if last.AuthorPHID == "" || date.IsZero() {
+		return "", time.Time{}, false
+	}
+
+	// Authors are known by name where they could be looked up.
+	name, user := last.AuthorPHID, last.AuthorPHID
+	if last.Author != "" {
+		name, user = last.Author, last.Author
+		if last.AuthorName != "" {
+			name = last.AuthorName
+		}
+	}
+	return fmt.Sprintf("%s <%s@%s>", name, user, noReplyDomain), date, true
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+// Manifest entries for named macros with the given image hashes, e.g.
+// "party=a1" for party with the SHA-256 "a1".
+func entries(specs ...string) []scraper.ManifestEntry {
+	var result []scraper.ManifestEntry
+	for _, spec := range specs {
+		name, sha, _ := strings.Cut(spec, "=")
+		result = append(result, scraper.ManifestEntry{Name: name, Path: name + ".gif", SHA256: sha})
+	}
+	return result
+}
+
+func names(entries []scraper.ManifestEntry) string {
+	var result []string
+	for _, entry := range entries {
+		result = append(result, entry.Name)
+	}
+	return strings.Join(result, ",")
+}
+
+func TestDiffManifests(t *testing.T) {
+	tests := []struct {
+		name                    string
+		prev, next              []scraper.ManifestEntry
+		selected                string
+		added, changed, removed string
+		kept                    string // the macros in the rewritten manifest
+	}{
+		{
+			name:     "first scrape",
+			next:     entries("cat=1", "party=2"),
+			selected: "cat,party",
+			added:    "cat,party",
+			kept:     "cat,party",
+		},
+		{
+			name:     "nothing changed",
+			prev:     entries("cat=1", "party=2"),
+			next:     entries("cat=1", "party=2"),
+			selected: "cat,party",
+			kept:     "cat,party",
+		},
+		{
+			name:     "added, changed and removed",
+			prev:     entries("cat=1", "party=2", "shrug=3"),
+			next:     entries("cat=1", "party=9", "shipit=4"),
+			selected: "cat,party,shipit",
+			added:    "shipit",
+			changed:  "party",
+			removed:  "shrug",
+			kept:     "cat,party,shipit",
+		},
+		{
+			name:     "selected but not written",
+			prev:     entries("cat=1", "party=2"),
+			next:     entries("cat=1"),
+			selected: "cat,party",
+			kept:     "cat,party",
+		},
+		{
+			name:     "no longer selected",
+			prev:     entries("cat=1", "party=2"),
+			next:     entries("cat=1"),
+			selected: "cat",
+			removed:  "party",
+			kept:     "cat",
+		},
+		{
+			name: "moved by the layout",
+			prev: entries("cat=1"),
+			next: []scraper.ManifestEntry{
+				{Name: "cat", Path: "alice/cat.gif", SHA256: "1"},
+			},
+			selected: "cat",
+			changed:  "cat",
+			kept:     "cat",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selected := make(map[string]bool)
+			for _, name := range strings.Split(test.selected, ",") {
+				selected[name] = true
+			}
+			next := &scraper.Manifest{Macros: test.next}
+			changes := diffManifests(&scraper.Manifest{Macros: test.prev}, next, selected)
+
+			for _, group := range []struct {
+				what      string
+				got, want string
+			}{
+				{"added", names(changes.added), test.added},
+				{"changed", names(changes.changed), test.changed},
+				{"removed", names(changes.removed), test.removed},
+				{"kept", names(next.Macros), test.kept},
+			} {
+				if group.got != group.want {
+					t.Errorf("%s %q, want %q", group.what, group.got, group.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCommitMessage(t *testing.T) {
+	tests := []struct {
+		name          string
+		changes       snapshot
+		subject, body string
+	}{
+		{
+			name:    "one added",
+			changes: snapshot{added: entries("party")},
+			subject: "Add 1 macro from https://phab.example.com",
+			body:    "Added: party",
+		},
+		{
+			name:    "added and removed",
+			changes: snapshot{added: entries("shrug", "party"), removed: entries("cat")},
+			subject: "Add 2 and remove 1 macros from https://phab.example.com",
+			body:    "Added: party, shrug\nRemoved: cat",
+		},
+		{
+			name:    "every kind",
+			changes: snapshot{added: entries("party"), changed: entries("shipit"), removed: entries("cat")},
+			subject: "Add 1, change 1 and remove 1 macros from https://phab.example.com",
+			body:    "Added: party\nChanged: shipit\nRemoved: cat",
+		},
+		{
+			name:    "only changed",
+			changes: snapshot{changed: entries("cat", "party")},
+			subject: "Change 2 macros from https://phab.example.com",
+			body:    "Changed: cat, party",
+		},
+	}
+	for _, test := range tests {
+		subject, body := commitMessage("https://phab.example.com", test.changes)
+		if subject != test.subject || body != test.body {
+			t.Errorf("%s: got %q, %q, want %q, %q", test.name, subject, body, test.subject, test.body)
+		}
+	}
+}
+
+func TestCommitAuthor(t *testing.T) {
+	jan := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	alice := scraper.ManifestEntry{AuthorPHID: "PHID-USER-alice", Author: "alice", AuthorName: "Alice Liddell", Created: jan}
+	alice2 := alice
+	alice2.Created = feb
+	bob := scraper.ManifestEntry{AuthorPHID: "PHID-USER-bob", Created: feb}
+
+	tests := []struct {
+		name    string
+		changes snapshot
+		author  string
+		date    time.Time
+		ok      bool
+	}{
+		{"one author", snapshot{added: []scraper.ManifestEntry{alice}}, "Alice Liddell <alice@users.noreply.invalid>", jan, true},
+		{"newest date", snapshot{added: []scraper.ManifestEntry{alice}, changed: []scraper.ManifestEntry{alice2}}, "Alice Liddell <alice@users.noreply.invalid>", feb, true},
+		{"not looked up", snapshot{added: []scraper.ManifestEntry{bob}}, "PHID-USER-bob <PHID-USER-bob@users.noreply.invalid>", feb, true},
+		{"several authors", snapshot{added: []scraper.ManifestEntry{alice, bob}}, "", time.Time{}, false},
+		{"unknown author", snapshot{added: []scraper.ManifestEntry{{Created: jan}}}, "", time.Time{}, false},
+		{"undated", snapshot{added: []scraper.ManifestEntry{{AuthorPHID: "PHID-USER-alice"}}}, "", time.Time{}, false},
+		{"only removed", snapshot{removed: []scraper.ManifestEntry{alice}}, "", time.Time{}, false},
+	}
+	for _, test := range tests {
+		author, date, ok := commitAuthor(test.changes)
+		if author != test.author || !date.Equal(test.date) || ok != test.ok {
+			t.Errorf("%s: got %q, %v, %v, want %q, %v, %v", test.name, author, date, ok, test.author, test.date, test.ok)
+		}
+	}
+}
+
+func TestCommitScrapeWithoutIdentity(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	// Hide any identity the machine has.
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(home, "gitconfig"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL", "EMAIL"} {
+		t.Setenv(name, "")
+	}
+
+	dir := t.TempDir()
+	repo := &gitRepo{dir: dir}
+	if _, err := repo.git(nil, "init", "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.check(); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if !repo.anonymous {
+		t.Fatal("check found an identity to commit as")
+	}
+
+	sink := scraper.NewDirSink(dir)
+	if err := scraper.WriteObject(sink, "party.gif", []byte("GIF89a party")); err != nil {
+		t.Fatal(err)
+	}
+	inst := instance{client: &scraper.Client{Host: "https://phab.example.com"}, sink: sink, dir: dir}
+	next := &scraper.Manifest{Macros: entries("party=1")}
+	if _, err := repo.commitScrape(inst, &scraper.Manifest{}, next, map[string]bool{"party": true}); err != nil {
+		t.Fatalf("commitScrape: %v", err)
+	}
+
+	committer, err := repo.git(nil, "log", "-1", "--format=%an <%ae> / %cn <%ce>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "scrape-phabricator-macros <scrape-phabricator-macros@users.noreply.invalid>"
+	if committer != want+" / "+want {
+		t.Errorf("committed as %s, want %s", committer, want)
+	}
+}
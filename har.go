@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+// Response bodies longer than this are truncated in traces. file.download
+// responses hold whole images as base64, which would bloat a trace without
+// helping anyone debug it.
+const harMaxBodyBytes = 4096
+
+// harRecorder is an http.RoundTripper which records every exchange it carries
+// so they can be written out as a HAR (HTTP Archive) file, with API tokens
+// redacted.
+type harRecorder struct {
+	next http.RoundTripper
+
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+func newHARRecorder(next http.RoundTripper) *harRecorder {
+	return &harRecorder{next: next}
+}
+
+func (h *harRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		if reqBody, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	start := time.Now()
+	resp, err := h.next.RoundTrip(req)
+	if err != nil {
+		h.record(harEntry{
+			StartedDateTime: start,
+			Time:            milliseconds(time.Since(start)),
+			Request:         harRequestFrom(req, reqBody),
+			Response:        harResponse{Headers: []harNameValue{}, Cookies: []harNameValue{}, Comment: err.Error()},
+			Cache:           struct{}{},
+			Timings:         harTimings{Wait: milliseconds(time.Since(start))},
+		})
+		return nil, err
+	}
+
+	// Read the body so it can be recorded, then hand the caller a copy.
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	elapsed := time.Since(start)
+
+	content := harContent{
+		Size:     len(respBody),
+		MimeType: resp.Header.Get("Content-Type"),
+		Text:     string(respBody),
+	}
+	if len(respBody) > harMaxBodyBytes {
+		content.Text = string(respBody[:harMaxBodyBytes])
+		content.Comment = fmt.Sprintf("truncated from %d bytes", len(respBody))
+	}
+	if err != nil {
+		content.Comment = "failed to read body: " + err.Error()
+	}
+
+	h.record(harEntry{
+		StartedDateTime: start,
+		Time:            milliseconds(elapsed),
+		Request:         harRequestFrom(req, reqBody),
+		Response: harResponse{
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			HTTPVersion: resp.Proto,
+			Headers:     harHeaders(resp.Header),
+			Cookies:     []harNameValue{},
+			Content:     content,
+			HeadersSize: -1,
+			BodySize:    len(respBody),
+		},
+		Cache:   struct{}{},
+		Timings: harTimings{Wait: milliseconds(elapsed)},
+	})
+
+	// A RoundTripper returns a response or an error, never both.
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (h *harRecorder) record(entry harEntry) {
+	h.mu.Lock()
+	h.entries = append(h.entries, entry)
+	h.mu.Unlock()
+}
+
+// Write everything recorded so far to a HAR file at path.
+func (h *harRecorder) writeFile(path string) error {
+	h.mu.Lock()
+	entries := append([]harEntry{}, h.entries...)
+	h.mu.Unlock()
+
+	var har harFile
+	har.Log.Version = "1.2"
+	har.Log.Creator.Name = "scrape-phabricator-macros"
+	har.Log.Entries = entries
+	if har.Log.Entries == nil {
+		har.Log.Entries = []harEntry{}
+	}
+
+	data, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Tokens are redacted, but the trace still describes a private instance.
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func harRequestFrom(req *http.Request, body []byte) harRequest {
+	url := scraper.RedactURL(req.URL.String())
+	r := harRequest{
+		Method:      req.Method,
+		URL:         url,
+		HTTPVersion: req.Proto,
+		Headers:     harHeaders(req.Header),
+		QueryString: []harNameValue{},
+		Cookies:     []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			if name == "api.token" {
+				value = "REDACTED"
+			}
+			r.QueryString = append(r.QueryString, harNameValue{Name: name, Value: value})
+		}
+	}
+	if len(body) > 0 {
+		r.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     redactForm(string(body)),
+		}
+	}
+	return r
+}
+
+// Headers which may carry credentials are redacted.
+func harHeaders(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			switch http.CanonicalHeaderKey(name) {
+			case "Authorization", "Cookie", "Set-Cookie":
+				value = "REDACTED"
+			}
+			headers = append(headers, harNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+// Redact the API token from a URL-encoded form body.
+func redactForm(body string) string {
+	return scraper.RedactURL("?" + body)[1:]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// The subset of the HAR 1.2 format we write. See
+// http://www.softwareishard.com/blog/har-12-spec/.
+type harFile struct {
+	Log struct {
+		Version string `json:"version"`
+		Creator struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+	Comment     string         `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harNameValue serves for headers, query parameters and cookies.
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
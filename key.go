@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"unicode"
+)
+
+// The environment variable consulted for the API key when no key flag is given.
+const keyEnvVar = "PHABRICATOR_API_KEY"
+
+// keySource holds the mutually exclusive ways of passing the API key as flags.
+type keySource struct {
+	key        string // the key itself, which is visible in ps output
+	keyFile    string // a file containing the key
+	keyCommand string // a command which prints the key to stdout
+}
+
+// Resolve the API key. At most one of the key flags may be given, and any of
+// them takes precedence over the PHABRICATOR_API_KEY environment variable.
+// Returns "" if no key was found, in which case the caller may fall back to
+// ~/.arcrc.
+func (s keySource) resolve() (string, error) {
+	var given int
+	for _, flag := range []string{s.key, s.keyFile, s.keyCommand} {
+		if flag != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return "", errors.New("only one of -key, -keyFile and -keyCommand may be specified")
+	}
+
+	switch {
+	case s.key != "":
+		return s.key, nil
+	case s.keyFile != "":
+		return readKeyFile(s.keyFile)
+	case s.keyCommand != "":
+		return runKeyCommand(s.keyCommand)
+	default:
+		return strings.TrimSpace(os.Getenv(keyEnvVar)), nil
+	}
+}
+
+// apiKeys are the keys resolved from the flags or environment: either one key,
+// or a key per host given as host=key pairs separated by commas or whitespace,
+// e.g. "https://phab.example.com=api-abc,https://phorge.example.com=api-def".
+type apiKeys struct {
+	shared  string
+	perHost map[string]string // by normalized host
+}
+
+// Parse a resolved key, which may be "" if none was given.
+func parseKeys(value string) (apiKeys, error) {
+	fields := strings.FieldsFunc(value, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	if len(fields) == 1 && !strings.Contains(fields[0], "=") {
+		return apiKeys{shared: fields[0]}, nil
+	}
+
+	keys := apiKeys{perHost: make(map[string]string)}
+	for _, field := range fields {
+		host, key, ok := strings.Cut(field, "=")
+		host = normalizeHost(host)
+		if !ok || host == "" || key == "" {
+			return apiKeys{}, errors.New("expected a single API key, or host=key pairs with one key per host")
+		} else if _, ok := keys.perHost[host]; ok {
+			return apiKeys{}, fmt.Errorf("more than one API key given for %s", host)
+		}
+		keys.perHost[host] = key
+	}
+	return keys, nil
+}
+
+// Refuse to send a single key to several hosts unless told they share it, since
+// one instance's key would otherwise be handed to the others' operators.
+func (k apiKeys) check(numHosts int, shareKey bool) error {
+	if k.shared != "" && numHosts > 1 && !shareKey {
+		return fmt.Errorf(
+			"a single API key would be sent to all %d hosts; give each its own as host=key pairs, "+
+				"or pass -shareKey if they really share one",
+			numHosts,
+		)
+	}
+	return nil
+}
+
+// The key to use for a host: its own if one was given, or else the single key
+// given for every host, or failing both, the host's token in ~/.arcrc.
+func (k apiKeys) forHost(rc arcrc, host string) string {
+	if key, ok := k.perHost[normalizeHost(host)]; ok {
+		return key
+	} else if k.shared != "" {
+		return k.shared
+	}
+	return rc.token(host)
+}
+
+// Read a key from a file, refusing to use it if other users can read it.
+func readKeyFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	// Windows doesn't have meaningful Unix permission bits to check.
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf(
+			"%s is accessible by other users (mode %04o); run chmod 600 on it",
+			path,
+			info.Mode().Perm(),
+		)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(contents))
+	if key == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return key, nil
+}
+
+// Run a credential helper through the shell and use its stdout as the key.
+// The helper's stderr is passed through so it can prompt or explain failures.
+func runKeyCommand(command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("-keyCommand failed: %v", err)
+	}
+	key := strings.TrimSpace(stdout.String())
+	if key == "" {
+		return "", errors.New("-keyCommand printed nothing")
+	}
+	return key, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestKeySourceResolve(t *testing.T) {
+	dir := t.TempDir()
+	writeKey := func(name, contents string, mode os.FileMode) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), mode); err != nil {
+			t.Fatal(err)
+		}
+		// WriteFile's mode is subject to the umask.
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	private := writeKey("private", "api-file\n", 0600)
+	readOnly := writeKey("read-only", "api-file", 0400)
+	shared := writeKey("shared", "api-file", 0644)
+	groupReadable := writeKey("group-readable", "api-file", 0640)
+	empty := writeKey("empty", " \n", 0600)
+
+	tests := []struct {
+		name    string
+		source  keySource
+		env     string
+		want    string
+		wantErr string
+	}{
+		{name: "flag", source: keySource{key: "api-flag"}, env: "api-env", want: "api-flag"},
+		{name: "file", source: keySource{keyFile: private}, env: "api-env", want: "api-file"},
+		{name: "read-only file", source: keySource{keyFile: readOnly}, want: "api-file"},
+		{name: "command", source: keySource{keyCommand: "echo api-command"}, env: "api-env", want: "api-command"},
+		{name: "environment", env: "  api-env\n", want: "api-env"},
+		{name: "nothing, for ~/.arcrc to fill in", want: ""},
+		{name: "two flags", source: keySource{key: "api-flag", keyFile: private}, wantErr: "only one of -key, -keyFile and -keyCommand"},
+		{name: "missing file", source: keySource{keyFile: filepath.Join(dir, "missing")}, wantErr: "no such file"},
+		{name: "world-readable file", source: keySource{keyFile: shared}, wantErr: "accessible by other users (mode 0644); run chmod 600"},
+		{name: "group-readable file", source: keySource{keyFile: groupReadable}, wantErr: "accessible by other users (mode 0640)"},
+		{name: "empty file", source: keySource{keyFile: empty}, wantErr: "is empty"},
+		{name: "failing command", source: keySource{keyCommand: "exit 3"}, env: "api-env", wantErr: "-keyCommand failed"},
+		{name: "silent command", source: keySource{keyCommand: "true"}, env: "api-env", wantErr: "-keyCommand printed nothing"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if runtime.GOOS == "windows" && strings.Contains(test.wantErr, "other users") {
+				t.Skip("Windows has no permission bits to check")
+			}
+			t.Setenv(keyEnvVar, test.env)
+			got, err := test.source.resolve()
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got %q, %v, want an error containing %q", got, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		name, value string
+		want        apiKeys
+		wantErr     string
+	}{
+		{name: "none", value: "", want: apiKeys{perHost: map[string]string{}}},
+		{name: "one key", value: "api-abc", want: apiKeys{shared: "api-abc"}},
+		{
+			name:  "a key per host",
+			value: "https://phab.example.com=api-abc,https://phorge.example.com/api/=api-def",
+			want: apiKeys{perHost: map[string]string{
+				"https://phab.example.com":   "api-abc",
+				"https://phorge.example.com": "api-def",
+			}},
+		},
+		{
+			name:  "one per line",
+			value: "https://phab.example.com=api-abc\nhttps://phorge.example.com=api-def\n",
+			want: apiKeys{perHost: map[string]string{
+				"https://phab.example.com":   "api-abc",
+				"https://phorge.example.com": "api-def",
+			}},
+		},
+		{name: "several bare keys", value: "api-abc,api-def", wantErr: "expected a single API key, or host=key pairs"},
+		{name: "mixed", value: "https://phab.example.com=api-abc,api-def", wantErr: "expected a single API key, or host=key pairs"},
+		{name: "no key", value: "https://phab.example.com=", wantErr: "expected a single API key, or host=key pairs"},
+		{name: "no host", value: "=api-abc", wantErr: "expected a single API key, or host=key pairs"},
+		{
+			name:    "two keys for a host",
+			value:   "https://phab.example.com=api-abc,https://phab.example.com/=api-def",
+			wantErr: "more than one API key given for https://phab.example.com",
+		},
+	}
+	for _, test := range tests {
+		got, err := parseKeys(test.value)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got %v, %v, want an error containing %q", test.name, got, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestKeyForHost(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	arcrcJSON := `{"hosts": {"https://phab.example.com/api/": {"token": "api-arcrc"}}}`
+	if err := os.WriteFile(filepath.Join(home, ".arcrc"), []byte(arcrcJSON), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := readArcrc()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, key, host, want string
+	}{
+		{"a given key wins", "api-flag", "https://phab.example.com", "api-flag"},
+		{"the host's own key wins", "https://phab.example.com=api-flag", "https://phab.example.com", "api-flag"},
+		{"whatever the trailing slash", "https://phab.example.com/=api-flag", "https://phab.example.com", "api-flag"},
+		{"falls back to ~/.arcrc", "", "https://phab.example.com/", "api-arcrc"},
+		{"host without its own key", "https://phorge.example.com=api-flag", "https://phab.example.com", "api-arcrc"},
+		{"host not in ~/.arcrc", "https://phab.example.com=api-flag", "https://phorge.example.com", ""},
+	}
+	for _, test := range tests {
+		keys, err := parseKeys(test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := keys.forHost(rc, test.host); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestKeysCheck(t *testing.T) {
+	perHost, err := parseKeys("https://phab.example.com=api-abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		keys     apiKeys
+		numHosts int
+		shareKey bool
+		wantErr  bool
+	}{
+		{"one key, one host", apiKeys{shared: "api-abc"}, 1, false, false},
+		{"one key, several hosts", apiKeys{shared: "api-abc"}, 2, false, true},
+		{"one key, shared", apiKeys{shared: "api-abc"}, 2, true, false},
+		{"a key per host", perHost, 2, false, false},
+		{"no key", apiKeys{}, 2, false, false},
+	}
+	for _, test := range tests {
+		if err := test.keys.check(test.numHosts, test.shareKey); (err != nil) != test.wantErr {
+			t.Errorf("%s: got %v, want an error: %v", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -1,304 +1,907 @@
 package main
 
 import (
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"io"
+	"log/slog"
 	liburl "net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/cheggaaa/pb"
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
 )
 
 func main() {
+	// Subcommands work with what an earlier scrape left in its directory.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gallery":
+			if err := runGallery(os.Args[2:]); err != nil {
+				fmt.Println("Failed to build gallery:", err)
+				os.Exit(1)
+			}
+			return
+		case "serve":
+			if err := runServe(os.Args[2:]); err != nil {
+				fmt.Println("Failed to serve:", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 
-	// Get config from flags. This struct contains client and writer abstractions
-	// which give us access to the outside world - specifically, to the
-	// Phabricator HTTP API and to the local filesystem.
+	// Get config from flags. This struct contains a client and sink abstraction
+	// per Phabricator instance, which give us access to the outside world -
+	// specifically, to the Phabricator HTTP API and to the local filesystem.
 	config, err := getConfig()
 	if err != nil {
 		fmt.Println("Failed to get config:", err)
 		os.Exit(1)
 	}
 
-	// Test the writer before sending any HTTP requests so we can short-circuit;
-	// we want to avoid sending a single HTTP request if we can anticipate a local
-	// filesystem error, such as incorrect permissions.
-	if err := config.writer.test(); err != nil {
-		fmt.Println("Can't write to specified directory:", err)
-		os.Exit(1)
-	}
+	var (
+		state = &runState{
+			bar:        makeProgress(config.showProgress),
+			log:        config.log,
+			events:     config.events,
+			metrics:    config.metrics,
+			errors:     makeErrorSet(),
+			skipped:    makeErrorSet(),
+			duplicates: makeErrorSet(),
+			budget:     &budget{limits: config.limits},
+			multiple:   len(config.instances) > 1,
+			started:    time.Now(),
+		}
+		wg    = new(sync.WaitGroup)
+		ready []instance
+	)
 
-	// Get a list of all macros so we know which images to fetch.
-	macros, err := config.client.getMacros()
-	if err != nil {
-		fmt.Println("Failed to fetch macros:", err)
+	// Run the pre-flight checks for each instance so that a bad host, key or
+	// directory is reported clearly up front. The sink is tested before any
+	// HTTP requests are sent, so we can short-circuit on local filesystem
+	// errors such as incorrect permissions.
+	for _, inst := range config.instances {
+		if printChecks(config.out, inst.client.Host, preflight(inst, config.dryRun, state.multiple)) {
+			ready = append(ready, inst)
+		} else {
+			state.instanceFailed(inst, errors.New("pre-flight checks failed"))
+		}
+	}
+	if len(ready) == 0 {
+		finishRun(config, state)
 		os.Exit(1)
 	}
 
-	var (
-		bar      = pb.New(len(macros))
-		wg       = new(sync.WaitGroup)
-		errorSet = makeErrorSet()
-		channels = makeChannels()
-	)
-
-	bar.Start()
+	// A dry run only lists what each instance's scrape would do.
+	if config.dryRun {
+		for _, inst := range ready {
+			plan, err := planInstance(inst, config)
+			if err != nil {
+				state.instanceFailed(inst, err)
+				continue
+			}
+			printPlan(config.out, inst, config, plan)
+		}
+		state.errors.printAll(config.out, "errors")
+		finishRun(config, state)
+		os.Exit(state.exitCode())
+	}
 
-	// Start as many goroutines fetching images as specified in the config.
-	for i := 0; i < config.numConcurrentFetches; i++ {
-		go getMacroImage(config.client, channels)
+	// The -out archive or bucket is shared by every instance, so it's opened
+	// once there's something to put in it.
+	if config.output != nil {
+		if err := config.output.Open(); err != nil {
+			fmt.Fprintln(config.out, "Can't open output:", err)
+			finishRun(config, state)
+			os.Exit(1)
+		}
 	}
 
-	// Wait for image bytes to come through so we can write them to files locally.
-	go handleImage(channels, errorSet, wg, config.writer, bar)
+	state.bar.start()
 
-	// Actually queue the macros up for retrieval.
-	for _, macro := range macros {
-		channels.pending <- macro
+	// Scrape every instance concurrently into the same progress bar and error
+	// set. A failure to list one instance's macros doesn't affect the others.
+	for _, inst := range ready {
 		wg.Add(1)
+		go func(inst instance) {
+			defer wg.Done()
+			if err := scrapeInstance(inst, config, state); err != nil {
+				state.instanceFailed(inst, err)
+			}
+		}(inst)
 	}
 
 	wg.Wait()
+	state.bar.finish()
 
-	// When we're done, close all the channels and print all the errors.
-	channels.closeAll()
-	errorSet.printAll()
-}
+	// An archive is only complete once it's closed.
+	if config.output != nil {
+		if err := config.output.Close(); err != nil {
+			state.outputFailed(fmt.Errorf("failed to finish output: %v", err))
+		}
+	}
 
-type config struct {
-	client               client
-	writer               writer
-	numConcurrentFetches int
+	state.events.emit(event{Type: eventRunSummary, Summary: state.summary(len(config.instances))})
+	state.duplicates.printAll(config.out, "duplicate groups")
+	state.skipped.printAll(config.out, "skipped")
+	state.errors.printAll(config.out, "errors")
+
+	finishRun(config, state)
+	os.Exit(state.exitCode())
 }
 
-func getConfig() (config, error) {
-	host := flag.String("host", "", "the host of the Phabricator instance")
-	key := flag.String("key", "", "the Conduit API key for Phabricator")
-	dir := flag.String("dir", "", "the output directory for the macro images")
-	numConcurrentFetches := flag.Int(
-		"numConcurrentFetches",
-		50,
-		"number of HTTP requests to have in-flight concurrently",
-	)
+// Write out the metrics and HTTP trace, if they were asked for, and the users
+// looked up, once the run is over. A dry run writes none of them.
+func finishRun(config config, state *runState) {
+	config.metrics.finish(time.Since(state.started), state.exitCode() == 0)
+	if config.dryRun {
+		return
+	}
+	if err := config.users.Save(); err != nil {
+		config.log.Warn("failed to save user cache", "error", err)
+	}
+	if config.metricsFile != "" {
+		if err := config.metrics.writeFile(config.metricsFile); err != nil {
+			config.log.Error("failed to write metrics file", "error", err)
+		}
+	}
+	if config.trace != nil {
+		if err := config.trace.writeFile(config.tracePath); err != nil {
+			config.log.Error("failed to write trace", "error", err)
+		}
+	}
+}
 
-	flag.Parse()
+// State shared by every instance scraped in a run. Everything that happens to
+// a macro goes through one of its methods, which keep the progress bar, logs,
+// event stream and end-of-run report in step with each other.
+type runState struct {
+	bar        *progress
+	log        *slog.Logger
+	events     *eventStream
+	metrics    *metrics
+	errors     *errorSet
+	skipped    *errorSet // macros deliberately not written, and why
+	duplicates *errorSet // groups of macros sharing an image, with -dedupe
+	budget     *budget
+	multiple   bool // whether several instances are being scraped
+	started    time.Time
+
+	mu              sync.Mutex
+	failedInstances int
+	failedOutputs   int
+	queued, written int
+	bytesWritten    int64
+}
 
-	if *host == "" {
-		return config{}, errors.New("please specify a Phabricator host with the -host flag")
-	} else if *key == "" {
-		return config{}, errors.New("please specify an API key with the -key flag")
-	} else if *dir == "" {
-		return config{}, errors.New("please specify an output directory with the -dir flag")
+// Errors in the end-of-run report say which instance they came from when
+// there's more than one.
+func (s *runState) describe(inst instance, m scraper.Macro, err error) error {
+	if m.Name != "" {
+		err = fmt.Errorf("%s: %v", m.Name, err)
 	}
+	if s.multiple {
+		err = fmt.Errorf("%s: %v", inst.client.Host, err)
+	}
+	return err
+}
 
-	return config{
-		client:               client{host: *host, key: *key},
-		writer:               writer{dir: *dir},
-		numConcurrentFetches: *numConcurrentFetches,
-	}, nil
+func (s *runState) instanceFailed(inst instance, err error) {
+	inst.client.Logger.Error("scrape failed", "error", err)
+	s.errors.add(fmt.Errorf("%s: %v", inst.client.Host, err))
+
+	s.mu.Lock()
+	s.failedInstances++
+	s.mu.Unlock()
 }
 
-// A collection of channels for queueing the retrieval of macros and writing of
-// images.
-type channels struct {
-	pending chan macro
-	errors  chan error
-	images  chan macroImage
+// Writing to the output failed other than for a single macro.
+func (s *runState) outputFailed(err error) {
+	s.log.Error("output failed", "error", err)
+	s.errors.add(err)
+
+	s.mu.Lock()
+	s.failedOutputs++
+	s.mu.Unlock()
 }
 
-func (c *channels) closeAll() {
-	close(c.pending)
-	close(c.errors)
-	close(c.images)
+func (s *runState) listingStarted(inst instance) {
+	s.events.emit(event{Type: eventListingStarted, Host: inst.client.Host})
 }
 
-func makeChannels() *channels {
-	return &channels{
-		pending: make(chan macro),
-		errors:  make(chan error),
-		images:  make(chan macroImage),
-	}
+func (s *runState) listingCompleted(inst instance, listed, selected int) {
+	inst.client.Logger.Info("listed macros", "listed", listed, "selected", selected)
+	s.events.emit(event{
+		Type:     eventListingCompleted,
+		Host:     inst.client.Host,
+		Listed:   &listed,
+		Selected: &selected,
+	})
 }
 
-// A concurrency-safe list of errors.
-type errorSet struct {
-	mu     *sync.Mutex
-	errors []error
+func (s *runState) macroQueued(inst instance, m scraper.Macro) {
+	s.events.emit(event{Type: eventMacroQueued, Host: inst.client.Host, Macro: m.Name})
+
+	s.mu.Lock()
+	s.queued++
+	s.mu.Unlock()
 }
 
-func makeErrorSet() *errorSet {
-	return &errorSet{
-		mu:     new(sync.Mutex),
-		errors: make([]error, 0),
-	}
+func (s *runState) macroDownloaded(inst instance, image scraper.Image) {
+	s.events.emit(event{
+		Type:  eventMacroDownloaded,
+		Host:  inst.client.Host,
+		Macro: image.Name,
+		Bytes: int64(len(image.Body)),
+	})
 }
 
-func (set *errorSet) add(err error) {
-	set.mu.Lock()
-	set.errors = append(set.errors)
-	set.mu.Unlock()
+func (s *runState) macroWritten(inst instance, image scraper.Image, path string) {
+	s.metrics.macro(inst.client.Host, "written")
+	inst.client.Logger.Debug("wrote image", "macro", image.Name, "path", path, "bytes", len(image.Body))
+	s.events.emit(event{
+		Type:  eventMacroWritten,
+		Host:  inst.client.Host,
+		Macro: image.Name,
+		Path:  path,
+		Bytes: int64(len(image.Body)),
+	})
+
+	s.mu.Lock()
+	s.written++
+	s.bytesWritten += int64(len(image.Body))
+	s.mu.Unlock()
 }
 
-// Print each error on a new line to stdout.
-func (set *errorSet) printAll() {
-	set.mu.Lock()
-	if len(set.errors) > 0 {
-		fmt.Printf("%d errors:\n", len(set.errors))
-		for _, error := range set.errors {
-			fmt.Println("-", error)
+func (s *runState) macroSkipped(inst instance, m scraper.Macro, reason error) {
+	s.metrics.macro(inst.client.Host, "skipped")
+	inst.client.Logger.Warn("skipped image", "macro", m.Name, "reason", reason)
+	s.events.emit(event{Type: eventMacroSkipped, Host: inst.client.Host, Macro: m.Name, Reason: reason.Error()})
+	s.skipped.add(s.describe(inst, m, reason))
+}
+
+func (s *runState) macroFailed(inst instance, m scraper.Macro, err error) {
+	s.metrics.macro(inst.client.Host, "failed")
+	inst.client.Logger.Error("failed to scrape image", "macro", m.Name, "error", err)
+	s.events.emit(event{Type: eventMacroFailed, Host: inst.client.Host, Macro: m.Name, Error: err.Error()})
+	s.errors.add(s.describe(inst, m, err))
+}
+
+// Report each group of macros which share an image, largest first.
+func (s *runState) duplicatesFound(inst instance, groups map[string][]string) {
+	shas := make([]string, 0, len(groups))
+	for sha := range groups {
+		shas = append(shas, sha)
+	}
+	sort.Slice(shas, func(i, j int) bool {
+		if len(groups[shas[i]]) != len(groups[shas[j]]) {
+			return len(groups[shas[i]]) > len(groups[shas[j]])
 		}
+		return shas[i] < shas[j]
+	})
+	for _, sha := range shas {
+		inst.client.Logger.Info("duplicate images", "sha256", sha, "macros", groups[sha])
+		s.duplicates.add(s.describe(inst, scraper.Macro{}, fmt.Errorf(
+			"%s shared by %s",
+			sha[:12],
+			strings.Join(groups[sha], ", "),
+		)))
 	}
-	set.mu.Unlock()
 }
 
-// writer abstracts away interaction with the local filesystem.
-type writer struct {
-	dir string
+func (s *runState) summary(instances int) *runSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &runSummary{
+		Instances:       instances,
+		FailedInstances: s.failedInstances,
+		Queued:          s.queued,
+		Written:         s.written,
+		Skipped:         s.skipped.len(),
+		Failed:          s.errors.len() - s.failedInstances - s.failedOutputs,
+		Bytes:           s.bytesWritten,
+		DurationSeconds: time.Since(s.started).Seconds(),
+	}
 }
 
-// Write an image in .gif format to the filesystem.
-func (w writer) writeImage(image macroImage) error {
-	err := ioutil.WriteFile(filepath.Join(w.dir, image.name+".gif"), image.body, 0600)
-	if err != nil {
-		return err
+// A run fails if any instance couldn't be scraped at all, or the output
+// couldn't be finished.
+func (s *runState) exitCode() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failedInstances > 0 || s.failedOutputs > 0 {
+		return 1
 	}
-	return nil
+	return 0
 }
 
-// Write a test file to the filesystem at the specified directory just to see if
-// we can.
-func (w writer) test() error {
-	testFilePath := filepath.Join(w.dir, "test")
-	if err := ioutil.WriteFile(testFilePath, []byte("test"), 0600); err != nil {
+// Scrape a single instance's macros into its sink, returning an error only if
+// the scrape couldn't start; errors fetching or writing individual images are
+// collected in the run's error set.
+func scrapeInstance(inst instance, config config, state *runState) error {
+	// Committing a scrape compares it with the last one.
+	var prev *scraper.Manifest
+	if config.git != nil {
+		var err error
+		if prev, err = readManifestFile(inst.dir); err != nil {
+			return fmt.Errorf("failed to read previous manifest: %v", err)
+		}
+	}
+
+	state.listingStarted(inst)
+	selected := make(map[string]bool)
+	s := newScraper(
+		inst,
+		config,
+		scraper.WithManifest(),
+		scraper.WithDedupe(config.dedupe),
+		// Refuse to start if the images within -maxFileBytes won't fit.
+		scraper.OnList(func(listed int, macros []scraper.Macro) error {
+			state.listingCompleted(inst, listed, len(macros))
+			for _, m := range macros {
+				selected[m.Name] = true
+			}
+			within, _, estimate, _ := config.limits.partition(macros)
+			if err := config.limits.checkEstimate(inst.dir, estimate); err != nil {
+				return err
+			}
+			state.bar.addTotal(len(within))
+			return nil
+		}),
+		// Skip images known to be too large without fetching them.
+		scraper.OnMacro(func(m scraper.Macro) error {
+			if err := config.limits.checkFile(m.Size); err != nil {
+				state.macroSkipped(inst, m, err)
+				return err
+			}
+			state.macroQueued(inst, m)
+			return nil
+		}),
+		scraper.OnImage(func(image scraper.Image) error {
+			state.macroDownloaded(inst, image)
+			// Sizes may not have been known up front, so check the limits
+			// again against what was actually downloaded.
+			if err := state.budget.reserve(int64(len(image.Body))); err != nil {
+				state.macroSkipped(inst, image.Macro, err)
+				state.bar.increment()
+				return scraper.ErrSkip
+			}
+			return nil
+		}),
+		scraper.OnWrite(func(image scraper.Image, name string) {
+			state.macroWritten(inst, image, inst.location(name))
+			state.bar.increment()
+		}),
+		scraper.OnError(func(m scraper.Macro, err error) {
+			state.macroFailed(inst, m, err)
+			state.bar.increment()
+		}),
+	)
+	err := s.Run()
+	if closeErr := inst.sink.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
 		return err
 	}
-	return os.Remove(testFilePath)
+	inst.client.Logger.Info("finished scrape")
+
+	if config.git != nil {
+		changes, err := config.git.commitScrape(inst, prev, s.Manifest(), selected)
+		if err != nil {
+			return fmt.Errorf("failed to commit scrape: %v", err)
+		}
+		inst.client.Logger.Info(
+			"committed scrape",
+			"added", len(changes.added),
+			"changed", len(changes.changed),
+			"removed", len(changes.removed),
+		)
+	}
+
+	if config.dedupe != "" {
+		state.duplicatesFound(inst, scraper.DuplicateGroups(s.Manifest()))
+	}
+	return nil
 }
 
-// macro encodes for the name and file PHID (Phabricator ID) of a macro.
-type macro struct{ name, filePHID string }
+// Make a scraper for an instance, selecting macros and laying out images as
+// config says, with the given options on top. Scrapes and dry runs both go
+// through here so they agree on what would be fetched and where it would go.
+func newScraper(inst instance, config config, options ...scraper.Option) *scraper.Scraper {
+	return scraper.New(inst.client, append([]scraper.Option{
+		scraper.WithConcurrency(config.numConcurrentFetches),
+		scraper.WithFilter(config.filter),
+		scraper.WithSink(inst.sink),
+		scraper.WithLayout(config.layout),
+		scraper.WithAuthors(config.users),
+	}, options...)...)
+}
 
-// macroImage is a macro with its contents encoded as raw bytes.
-type macroImage struct {
-	macro
-	body []byte
+type config struct {
+	instances            []instance
+	filter               scraper.Filter
+	limits               sizeLimits
+	numConcurrentFetches int
+	dryRun               bool
+	git                  *gitRepo // nil unless -gitRepo was given
+	dedupe               string
+	layout               *scraper.Layout
+	users                *scraper.UserCache
+	log                  *slog.Logger
+	showProgress         bool
+	events               *eventStream // nil unless -events was given
+	metrics              *metrics     // nil unless -metricsAddr or -metricsFile was given
+	metricsFile          string
+	trace                *harRecorder // nil unless -trace was given
+	tracePath            string
+	out                  io.Writer    // for human-readable reports
+	output               scraper.Sink // nil unless -out was given
 }
 
-type client struct {
-	host, key string
+// A Phabricator instance to scrape and where to write its macros.
+type instance struct {
+	client *scraper.Client
+	sink   scraper.Sink
+	dir    string // the directory the sink writes to, or "" for -out
 }
 
-// Return the url for a GET request to the specified Phabricator API method.
-func (c client) methodURL(apiMethod string, params map[string]string) string {
-	return c.urlWithToken(c.host+"/api/"+apiMethod, params)
+// Where an object written to the instance's sink ended up, for humans: a file,
+// or a name within the archive or bucket.
+func (inst instance) location(name string) string {
+	if inst.dir == "" {
+		return name
+	}
+	return filepath.Join(inst.dir, filepath.FromSlash(name))
 }
 
-// Given a raw URL string and arbitrary query params, add the client's API token
-// to the params in the proper key and return the full encoded URL.
-func (c client) urlWithToken(url string, params map[string]string) string {
-	values := liburl.Values{"api.token": []string{c.key}}
-	for key, val := range params {
-		values[key] = []string{val}
+// The default user cache location, e.g. ~/.cache/scrape-phabricator-macros/
+// users.json on Linux. Returns "" if there's no cache directory.
+func defaultUserCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
 	}
-	return fmt.Sprintf("%s?%s", url, values.Encode())
+	return filepath.Join(dir, "scrape-phabricator-macros", "users.json")
 }
 
-// Retrieve a list of macros from the client's Phabricator instance
-// using the client's API key.
-func (c client) getMacros() ([]macro, error) {
-	var payload struct {
-		Result map[string]struct {
-			FilePHID string `json:"filePHID"`
-		} `json:"result"`
+func getConfig() (config, error) {
+	var hosts stringList
+	flag.Var(&hosts, "host", "the host of the Phabricator instance, or a comma-separated list of hosts")
+
+	var keys keySource
+	flag.StringVar(&keys.key, "key", "", "the Conduit API key for Phabricator, or host=key pairs with one per -host")
+	flag.StringVar(&keys.keyFile, "keyFile", "", "a file containing the Conduit API key, or host=key pairs")
+	flag.StringVar(&keys.keyCommand, "keyCommand", "", "a command which prints the Conduit API key, or host=key pairs")
+	shareKey := flag.Bool("shareKey", false, "send a single API key to every -host instead of requiring one per host")
+
+	dir := flag.String("dir", "", "the output directory for the macro images")
+	outPath := flag.String(
+		"out",
+		"",
+		"write the macro images into this .tar, .tar.gz or .zip archive or s3://bucket/prefix instead, or - for stdout",
+	)
+	outFormat := flag.String("outFormat", "", "the format of the -out archive, if not clear from its name: tar, tar.gz or zip")
+
+	dedupe := flag.String("dedupe", "", "store identical images once, linked by name: hardlink, symlink or manifest")
+	layout := flag.String(
+		"layout",
+		scraper.DefaultLayout,
+		"a template for where each macro's image is stored, e.g. {{.Author}}/{{.Name}}.{{.Ext}}",
+	)
+	gitRepoDir := flag.String("gitRepo", "", "write into this git working tree instead, committing the changes each scrape makes")
+
+	var s3 s3Options
+	flag.StringVar(&s3.endpoint, "s3Endpoint", "", "the endpoint of the S3-compatible service for -out=s3://..., if not AWS")
+	flag.StringVar(&s3.region, "s3Region", "", "the region of the -out bucket (default $AWS_REGION, or us-east-1)")
+	flag.BoolVar(&s3.pathStyle, "s3PathStyle", false, "address the -out bucket in the URL path, as most non-AWS services require")
+	numConcurrentFetches := flag.Int(
+		"numConcurrentFetches",
+		scraper.DefaultConcurrency,
+		"number of HTTP requests to have in-flight concurrently",
+	)
+	retries := flag.Int("retries", 3, "how many times to retry a Conduit call the server answers with HTTP 429 or 5xx")
+	userAgent := flag.String(
+		"userAgent",
+		"scrape-phabricator-macros",
+		"the User-Agent header to send with each request",
+	)
+
+	var transport transportOptions
+	flag.StringVar(&transport.caBundle, "caBundle", "", "a PEM file of additional CA certificates to trust")
+	flag.StringVar(&transport.clientCert, "clientCert", "", "a PEM client certificate for mutual TLS")
+	flag.StringVar(&transport.clientKey, "clientKey", "", "the PEM private key for -clientCert")
+	flag.BoolVar(
+		&transport.insecureSkipVerify,
+		"insecureSkipVerify",
+		false,
+		"skip verification of the server's TLS certificate (staging only!)",
+	)
+	flag.StringVar(&transport.proxy, "proxy", "", "an http://, https:// or socks5:// proxy URL")
+
+	var filter scraper.Filter
+	flag.Var((*stringList)(&filter.Include), "include", "comma-separated glob patterns of macro names to scrape")
+	flag.Var((*stringList)(&filter.Exclude), "exclude", "comma-separated glob patterns of macro names to skip")
+	flag.Var((*stringList)(&filter.Authors), "author", "comma-separated usernames of authors whose macros to scrape")
+	userCachePath := flag.String(
+		"userCache",
+		defaultUserCachePath(),
+		"where to cache the names of macros' authors between runs, or empty not to",
+	)
+
+	var limits sizeLimits
+	flag.Int64Var(&limits.maxFileBytes, "maxFileBytes", 0, "skip images larger than this many bytes (0 for no limit)")
+	flag.Int64Var(
+		&limits.maxTotalBytes,
+		"maxTotalBytes",
+		0,
+		"don't write more than this many bytes of images in total (0 for no limit)",
+	)
+
+	logFormat := flag.String("logFormat", "text", "the format of the logs written to stderr: text or json")
+	logLevel := flag.String("logLevel", "info", "the least severe level to log: debug, info, warn or error")
+
+	events := flag.String("events", "", "write an event stream to stdout in place of the progress bar: ndjson")
+
+	metricsAddr := flag.String("metricsAddr", "", "serve Prometheus metrics at /metrics on this address during the run, e.g. :9090")
+	metricsFile := flag.String("metricsFile", "", "write Prometheus metrics to this .prom file at the end of the run")
+
+	recordDir := flag.String("record", "", "record every Conduit exchange into this cassette directory")
+	replayDir := flag.String("replay", "", "answer Conduit requests from this cassette directory instead of the network")
+	tracePath := flag.String("trace", "", "record every Conduit request and response to this HAR file")
+
+	dryRun := flag.Bool("dryRun", false, "print what a scrape would do without downloading or writing anything")
+
+	configPath := flag.String("config", defaultConfigPath(), "the config file to read -profile from")
+	profile := flag.String("profile", "", "the named profile in the config file to use")
+
+	flag.Parse()
+
+	// Settings from the profile fill in whatever wasn't given on the command
+	// line; everything is validated below once they've been merged.
+	if *profile != "" {
+		if err := applyProfile(flag.CommandLine, *configPath, *profile); err != nil {
+			return config{}, err
+		}
 	}
 
-	resp, err := http.Get(c.methodURL("macro.query", nil))
+	key, err := keys.resolve()
 	if err != nil {
-		return nil, err
+		return config{}, err
 	}
-	defer resp.Body.Close()
-
-	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return nil, err
+	apiKeys, err := parseKeys(key)
+	if err != nil {
+		return config{}, err
 	}
 
-	var macros []macro
-	for macroName, payload := range payload.Result {
-		macros = append(macros, macro{name: macroName, filePHID: payload.FilePHID})
+	// Fall back to Arcanist's configuration for whichever of the hosts and keys
+	// weren't given, so keys needn't end up in shell history.
+	var rc arcrc
+	if len(hosts) == 0 || apiKeys.shared == "" {
+		if rc, err = readArcrc(); err != nil {
+			return config{}, fmt.Errorf("failed to read ~/.arcrc: %v", err)
+		}
+	}
+	if len(hosts) == 0 {
+		arcconfigURI, err := readArcconfigURI()
+		if err != nil {
+			return config{}, fmt.Errorf("failed to read .arcconfig: %v", err)
+		}
+		if host := rc.defaultHost(arcconfigURI); host != "" {
+			hosts = stringList{host}
+		}
 	}
 
-	return macros, nil
-}
+	if len(hosts) == 0 {
+		return config{}, errors.New("please specify a Phabricator host with the -host flag or in ~/.arcrc")
+	} else if err := apiKeys.check(len(hosts), *shareKey); err != nil {
+		return config{}, err
+	} else if countSet(*dir, *outPath, *gitRepoDir) != 1 {
+		return config{}, errors.New(
+			"please specify one of an output directory with the -dir flag, an archive or bucket with -out, " +
+				"or a git repository with -gitRepo",
+		)
+	} else if *outPath == "-" && *events != "" {
+		return config{}, errors.New("-out=- and -events both write to stdout, so can't be used together")
+	} else if *dedupe != "" && *dedupe != scraper.DedupeHardlink && *dedupe != scraper.DedupeSymlink &&
+		*dedupe != scraper.DedupeManifest {
+		return config{}, fmt.Errorf("invalid -dedupe %q: expected hardlink, symlink or manifest", *dedupe)
+	} else if *outPath != "" && (*dedupe == scraper.DedupeHardlink || *dedupe == scraper.DedupeSymlink) {
+		return config{}, errors.New("-out can't hold links, so only -dedupe=manifest can be used with it")
+	} else if *recordDir != "" && *replayDir != "" {
+		return config{}, errors.New("-record and -replay can't be used together")
+	} else if *retries < 0 {
+		return config{}, errors.New("-retries can't be negative")
+	} else if *numConcurrentFetches < 1 {
+		return config{}, errors.New("-numConcurrentFetches must be at least 1")
+	} else if limits.maxFileBytes < 0 || limits.maxTotalBytes < 0 {
+		return config{}, errors.New("-maxFileBytes and -maxTotalBytes can't be negative")
+	} else if *events != "" && *events != "ndjson" {
+		return config{}, fmt.Errorf("invalid -events %q: expected ndjson", *events)
+	} else if err := filter.Validate(); err != nil {
+		return config{}, err
+	}
 
-// Retrieve a given macro's image.
-func (c client) getMacroImage(macro macro) (macroImage, error) {
-	resp, err := http.Get(c.methodURL("file.download", map[string]string{
-		"phid": macro.filePHID,
-	}))
+	parsedLayout, err := scraper.ParseLayout(*layout)
 	if err != nil {
-		return macroImage{}, err
+		return config{}, err
 	}
-	defer resp.Body.Close()
 
-	// Oddly, images from the file.download endpoint come as base64-encoded
-	// strings, so we'll need to decode those before writing the bytes to disk.
-	var payload struct {
-		Result string `json:"result"` // a base64-encoded string
+	// A cache that can't be read is only a missed optimization.
+	users := scraper.NewUserCache()
+	if *userCachePath != "" {
+		if cache, err := scraper.LoadUserCache(*userCachePath); err != nil {
+			fmt.Fprintln(os.Stderr, "Ignoring user cache:", err)
+		} else {
+			users = cache
+		}
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return macroImage{}, err
+	logger, err := newLogger(*logFormat, *logLevel)
+	if err != nil {
+		return config{}, err
 	}
 
-	body, err := base64.StdEncoding.DecodeString(payload.Result)
+	httpClient, err := newHTTPClient(transport)
 	if err != nil {
-		return macroImage{}, err
+		return config{}, err
 	}
 
-	return macroImage{macro: macro, body: body}, nil
-}
+	// A replay never touches the network, while a recording sits in front of
+	// it. Either way, a trace wrapped around them sees every exchange.
+	if *replayDir != "" {
+		httpClient.Transport = cassettePlayer{dir: *replayDir}
+	} else if *recordDir != "" {
+		if err := os.MkdirAll(*recordDir, 0700); err != nil {
+			return config{}, err
+		}
+		httpClient.Transport = cassetteRecorder{dir: *recordDir, next: httpClient.Transport}
+	}
+
+	// Recording a trace wraps the transport so it sees every exchange.
+	var trace *harRecorder
+	if *tracePath != "" {
+		trace = newHARRecorder(httpClient.Transport)
+		httpClient.Transport = trace
+	}
+
+	var runMetrics *metrics
+	if *metricsAddr != "" || *metricsFile != "" {
+		runMetrics = newMetrics()
+	}
+	if *metricsAddr != "" {
+		if err := runMetrics.listen(*metricsAddr); err != nil {
+			return config{}, fmt.Errorf("failed to serve metrics: %v", err)
+		}
+	}
+
+	// A git repository is written like any output directory, then committed.
+	var repo *gitRepo
+	if *gitRepoDir != "" {
+		repo = &gitRepo{dir: *gitRepoDir}
+		if err := repo.check(); err != nil {
+			return config{}, err
+		}
+		if repo.anonymous {
+			logger.Warn(
+				"git has no user.name or user.email, so commits will be made as "+defaultIdentity,
+				"repo", *gitRepoDir,
+			)
+		}
+		*dir = *gitRepoDir
+	}
 
-// Loop forever, reading macros off the pending channel, sending the request
-// to get the corresponding image, and either passing the image or an error
-// back via a channel.
-func getMacroImage(client client, channels *channels) {
-	for {
-		macro := <-channels.pending
-		imageFile, err := client.getMacroImage(macro)
+	var output scraper.Sink
+	if *outPath != "" {
+		// S3 requests go straight to the network rather than through the
+		// Conduit client's recording and tracing.
+		s3HTTP, err := newHTTPClient(transport)
 		if err != nil {
-			channels.errors <- err
-		} else {
-			channels.images <- imageFile
+			return config{}, err
+		}
+		if output, err = newOutput(*outPath, *outFormat, s3, s3HTTP); err != nil {
+			return config{}, err
 		}
 	}
+
+	// Each instance gets its own client, and when there's more than one, its own
+	// subdirectory of the output directory, archive or bucket named after its
+	// host.
+	var instances []instance
+	for _, host := range hosts {
+		host = normalizeHost(host)
+		hostKey := apiKeys.forHost(rc, host)
+		// Cassettes don't record the key, so any will do for a replay.
+		if hostKey == "" && *replayDir != "" {
+			hostKey = "replay"
+		}
+		if hostKey == "" {
+			return config{}, fmt.Errorf(
+				"please specify an API key for %s with the -key, -keyFile or -keyCommand flag, "+
+					"the %s environment variable, or in ~/.arcrc",
+				host,
+				keyEnvVar,
+			)
+		}
+
+		// Per-instance subdirectories are ours to create; the output directory
+		// itself must already exist.
+		var (
+			instanceDir string
+			sink        scraper.Sink
+		)
+		switch {
+		case output != nil && len(hosts) > 1:
+			sink = scraper.WithPrefix(output, instanceDirName(host)+"/")
+		case output != nil:
+			sink = scraper.WithPrefix(output, "")
+		case len(hosts) > 1:
+			instanceDir = filepath.Join(*dir, instanceDirName(host))
+			sink = scraper.NewDirSink(instanceDir, scraper.WithMkdir(0700))
+		default:
+			instanceDir = *dir
+			sink = scraper.NewDirSink(instanceDir)
+		}
+
+		instances = append(instances, instance{
+			client: &scraper.Client{
+				Host:      host,
+				Token:     hostKey,
+				HTTP:      httpClient,
+				UserAgent: *userAgent,
+				Logger:    logger.With("host", host),
+				Observe: func(method string) func(int, int64) {
+					return runMetrics.startRequest(host, method)
+				},
+				Retries: *retries,
+				OnRetry: func(method string, err error) {
+					runMetrics.retry(host, method)
+				},
+			},
+			sink: sink,
+			dir:  instanceDir,
+		})
+	}
+
+	// The event stream or archive takes over stdout, so reports meant for
+	// humans move to stderr alongside the logs.
+	var (
+		eventStream *eventStream
+		out         io.Writer = os.Stdout
+	)
+	if *events == "ndjson" {
+		eventStream = newEventStream(os.Stdout)
+		out = os.Stderr
+	} else if *outPath == "-" {
+		out = os.Stderr
+	}
+
+	return config{
+		instances:            instances,
+		filter:               filter,
+		limits:               limits,
+		numConcurrentFetches: *numConcurrentFetches,
+		dryRun:               *dryRun,
+		git:                  repo,
+		dedupe:               *dedupe,
+		layout:               parsedLayout,
+		users:                users,
+		log:                  logger,
+		// The bar is only useful to a human watching a terminal, and would
+		// garble JSON logs written alongside it.
+		showProgress: stdoutIsTerminal() && *logFormat == "text" && out == os.Stdout,
+		events:       eventStream,
+		metrics:      runMetrics,
+		metricsFile:  *metricsFile,
+		trace:        trace,
+		tracePath:    *tracePath,
+		out:          out,
+		output:       output,
+	}, nil
 }
 
-// Loop forever, reading either images or errors. If an image, write to the
-// proper local file. Increment the bar and decrement the WaitGroup regardless.
-func handleImage(
-	channels *channels,
-	errorSet *errorSet,
-	wg *sync.WaitGroup,
-	writer writer,
-	bar *pb.ProgressBar,
-) {
-	for {
-		select {
-		case err := <-channels.errors:
-			errorSet.add(err)
-		case image := <-channels.images:
-			if err := writer.writeImage(image); err != nil {
-				errorSet.add(err)
-			}
+// Count how many of the given flags were set.
+func countSet(values ...string) int {
+	n := 0
+	for _, value := range values {
+		if value != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// The name of the subdirectory an instance's macros are written to when
+// scraping several at once, e.g. "phab.example.com" or "localhost_8080".
+func instanceDirName(host string) string {
+	name := host
+	if u, err := liburl.Parse(host); err == nil && u.Host != "" {
+		name = u.Host + u.Path
+	}
+	return strings.NewReplacer(":", "_", "/", "_").Replace(name)
+}
+
+// A concurrency-safe list of errors.
+type errorSet struct {
+	mu     *sync.Mutex
+	errors []error
+}
+
+func makeErrorSet() *errorSet {
+	return &errorSet{
+		mu:     new(sync.Mutex),
+		errors: make([]error, 0),
+	}
+}
+
+func (set *errorSet) add(err error) {
+	set.mu.Lock()
+	set.errors = append(set.errors, err)
+	set.mu.Unlock()
+}
+
+func (set *errorSet) len() int {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return len(set.errors)
+}
+
+// Print each error on a new line under a heading such as "3 errors:".
+func (set *errorSet) printAll(w io.Writer, noun string) {
+	set.mu.Lock()
+	if len(set.errors) > 0 {
+		fmt.Fprintf(w, "%d %s:\n", len(set.errors), noun)
+		for _, error := range set.errors {
+			fmt.Fprintln(w, "-", error)
 		}
-		bar.Increment()
-		wg.Done()
+	}
+	set.mu.Unlock()
+}
+
+// A progress bar shared by every instance being scraped, whose total grows as
+// each instance's macros are listed. A disabled bar does nothing, for when
+// there's no terminal to draw it on.
+type progress struct {
+	mu  sync.Mutex
+	bar *pb.ProgressBar
+}
+
+func makeProgress(enabled bool) *progress {
+	if !enabled {
+		return &progress{}
+	}
+	return &progress{bar: pb.New(0)}
+}
+
+func (p *progress) start() {
+	if p.bar != nil {
+		p.bar.Start()
+	}
+}
+
+func (p *progress) finish() {
+	if p.bar != nil {
+		p.bar.Finish()
+	}
+}
+
+func (p *progress) addTotal(n int) {
+	if p.bar != nil {
+		p.mu.Lock()
+		p.bar.SetTotal(p.bar.Total() + int64(n))
+		p.mu.Unlock()
+	}
+}
+
+func (p *progress) increment() {
+	if p.bar != nil {
+		p.bar.Increment()
 	}
 }
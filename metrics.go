@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+// The upper bounds of the request latency histogram's buckets, in seconds.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// metrics collects run statistics and renders them in the Prometheus text
+// exposition format. A nil *metrics ignores everything, so callers needn't
+// check whether metrics were asked for.
+type metrics struct {
+	mu         sync.Mutex
+	requests   map[string]float64 // by labels host, method and status
+	retries    map[string]float64 // by host and method
+	latencies  map[string]*histogram
+	downloaded map[string]float64 // bytes, by host
+	macros     map[string]float64 // by host and outcome
+	inFlight   float64
+
+	// Set at the end of a run, for alerting on nightly jobs.
+	finished bool
+	duration time.Duration
+	success  bool
+	lastRun  time.Time
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:   make(map[string]float64),
+		retries:    make(map[string]float64),
+		latencies:  make(map[string]*histogram),
+		downloaded: make(map[string]float64),
+		macros:     make(map[string]float64),
+	}
+}
+
+// Note that a Conduit request is about to be sent, returning a function which
+// records its outcome once it's done. A status of 0 means no response arrived.
+func (m *metrics) startRequest(host, method string) func(status int, bytes int64) {
+	if m == nil {
+		return func(int, int64) {}
+	}
+
+	m.mu.Lock()
+	m.inFlight++
+	m.mu.Unlock()
+
+	start := time.Now()
+	return func(status int, bytes int64) {
+		elapsed := time.Since(start).Seconds()
+		statusLabel := strconv.Itoa(status)
+		if status == 0 {
+			statusLabel = "error"
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.inFlight--
+		m.requests[labels("host", host, "method", method, "status", statusLabel)]++
+		m.downloaded[labels("host", host)] += float64(bytes)
+
+		key := labels("host", host, "method", method)
+		h := m.latencies[key]
+		if h == nil {
+			h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+			m.latencies[key] = h
+		}
+		for i, bound := range latencyBuckets {
+			if elapsed <= bound {
+				h.counts[i]++
+				break
+			}
+		}
+		h.sum += elapsed
+		h.count++
+	}
+}
+
+// Count a Conduit call being retried.
+func (m *metrics) retry(host, method string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.retries[labels("host", host, "method", method)]++
+	m.mu.Unlock()
+}
+
+// Count a macro's outcome: written, skipped or failed.
+func (m *metrics) macro(host, outcome string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.macros[labels("host", host, "outcome", outcome)]++
+	m.mu.Unlock()
+}
+
+// Record the end of the run.
+func (m *metrics) finish(duration time.Duration, success bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.finished = true
+	m.duration = duration
+	m.success = success
+	m.lastRun = time.Now()
+	m.mu.Unlock()
+}
+
+// Render every metric in the Prometheus text exposition format.
+func (m *metrics) writeTo(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	writeFamily(buf, "phabricator_macros_conduit_requests_total", "counter",
+		"Conduit requests sent, by method and HTTP status.", m.requests)
+	writeFamily(buf, "phabricator_macros_conduit_retries_total", "counter",
+		"Conduit calls retried after HTTP 429 or 5xx, by method.", m.retries)
+	writeFamily(buf, "phabricator_macros_downloaded_bytes_total", "counter",
+		"Bytes of Conduit responses received.", m.downloaded)
+	writeFamily(buf, "phabricator_macros_macros_total", "counter",
+		"Macros processed, by outcome: written, skipped or failed.", m.macros)
+	writeFamily(buf, "phabricator_macros_conduit_requests_in_flight", "gauge",
+		"Conduit requests currently awaiting a response.", map[string]float64{"": m.inFlight})
+
+	name := "phabricator_macros_conduit_request_duration_seconds"
+	fmt.Fprintf(buf, "# HELP %s Latency of Conduit requests, by method.\n# TYPE %s histogram\n", name, name)
+	for _, key := range sortedKeys(m.latencies) {
+		h := m.latencies[key]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(buf, "%s_bucket{%s,le=\"%s\"} %d\n", name, key, le, cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, key, h.count)
+		fmt.Fprintf(buf, "%s_sum{%s} %g\n", name, key, h.sum)
+		fmt.Fprintf(buf, "%s_count{%s} %d\n", name, key, h.count)
+	}
+
+	if m.finished {
+		success := 0.0
+		if m.success {
+			success = 1
+		}
+		writeFamily(buf, "phabricator_macros_last_run_duration_seconds", "gauge",
+			"How long the last run took.", map[string]float64{"": m.duration.Seconds()})
+		writeFamily(buf, "phabricator_macros_last_run_success", "gauge",
+			"Whether every instance in the last run was scraped.", map[string]float64{"": success})
+		writeFamily(buf, "phabricator_macros_last_run_timestamp_seconds", "gauge",
+			"When the last run finished, as a Unix timestamp.", map[string]float64{"": float64(m.lastRun.Unix())})
+	}
+
+	return buf.Flush()
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.writeTo(w)
+}
+
+// Serve the metrics on addr at /metrics until the process exits.
+func (m *metrics) listen(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	// A stalled scraper of the metrics mustn't hold a connection forever.
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	// Listen synchronously so that a port in use is reported up front.
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go server.Serve(listener)
+	return nil
+}
+
+// Write the metrics to path for the node exporter's textfile collector, which
+// requires the file to be replaced atomically.
+func (m *metrics) writeFile(path string) error {
+	w, err := scraper.NewDirSink(filepath.Dir(path), scraper.WithFileMode(0644)).Put(filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if err := m.writeTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func writeFamily(w io.Writer, name, kind, help string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, key := range sortedKeys(values) {
+		if key == "" {
+			fmt.Fprintf(w, "%s %g\n", name, values[key])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %g\n", name, key, values[key])
+		}
+	}
+}
+
+// Render label pairs, e.g. labels("method", "macro.query") is
+// `method="macro.query"`, for use as a map key and in the output.
+func labels(pairs ...string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], escaper.Replace(pairs[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+// An instance's macros as a scrape left them on disk, found by its manifest.
+type mirroredInstance struct {
+	dir      string // where the manifest and images are
+	manifest *scraper.Manifest
+}
+
+// Find the mirrored instances in an output directory: the directory itself, if
+// one instance was scraped into it, or else each of its subdirectories with a
+// manifest, as scraping several instances leaves them.
+func readMirror(dir string) ([]mirroredInstance, error) {
+	dirs, err := findManifests(dir)
+	if err != nil {
+		return nil, err
+	}
+	var mirror []mirroredInstance
+	for _, sub := range dirs {
+		manifest, err := readManifestFile(sub)
+		if err != nil {
+			if sub == dir {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%s: %v", sub, err)
+		}
+		mirror = append(mirror, mirroredInstance{dir: sub, manifest: manifest})
+	}
+	if len(mirror) == 0 {
+		return nil, fmt.Errorf("no %s in %s or its subdirectories", scraper.ManifestName, dir)
+	}
+	sort.Slice(mirror, func(i, j int) bool { return mirror[i].manifest.Host < mirror[j].manifest.Host })
+	return mirror, nil
+}
+
+// The directories holding the manifests readMirror reads, without reading
+// them.
+func findManifests(dir string) ([]string, error) {
+	if _, err := os.Stat(filepath.Join(dir, scraper.ManifestName)); err == nil {
+		return []string{dir}, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, entry := range entries {
+		sub := filepath.Join(dir, entry.Name())
+		if _, err := os.Stat(filepath.Join(sub, scraper.ManifestName)); entry.IsDir() && err == nil {
+			dirs = append(dirs, sub)
+		}
+	}
+	return dirs, nil
+}
+
+// The file holding a macro's image, refusing manifest paths that would lead
+// outside the instance's directory.
+func (inst mirroredInstance) imagePath(entry scraper.ManifestEntry) (string, error) {
+	path := filepath.FromSlash(entry.Path)
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("the manifest gives %s a path outside the directory: %s", entry.Name, entry.Path)
+	}
+	return filepath.Join(inst.dir, path), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	liburl "net/url"
+	"os"
+	"strings"
+
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+// s3Options describe how to reach the bucket of an s3:// -out.
+type s3Options struct {
+	endpoint  string
+	region    string
+	pathStyle bool
+}
+
+// Build the sink -out names: a bucket for s3://bucket/prefix, and otherwise an
+// archive written to a file or, for "-", to stdout.
+func newOutput(out, format string, s3 s3Options, httpClient *http.Client) (scraper.Sink, error) {
+	if strings.HasPrefix(out, "s3://") {
+		return newS3Output(out, s3, httpClient)
+	}
+
+	if format == "" {
+		var ok bool
+		if format, ok = scraper.ArchiveFormat(out); !ok {
+			return nil, fmt.Errorf("please specify the format of %s with -outFormat", out)
+		}
+	}
+	if out == "-" {
+		return scraper.NewArchiveSink(os.Stdout, format)
+	}
+	return scraper.NewArchiveFileSink(out, format)
+}
+
+// Credentials come from the standard AWS environment variables, so they
+// needn't be passed on the command line.
+func newS3Output(out string, s3 s3Options, httpClient *http.Client) (scraper.Sink, error) {
+	u, err := liburl.Parse(out)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid -out %q: expected s3://bucket/prefix", out)
+	}
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	config := scraper.S3Config{
+		Endpoint:        s3.endpoint,
+		Region:          s3.region,
+		Bucket:          u.Host,
+		Prefix:          prefix,
+		PathStyle:       s3.pathStyle,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		HTTP:            httpClient,
+	}
+	if config.Region == "" {
+		config.Region = os.Getenv("AWS_REGION")
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("please set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to write to S3")
+	}
+	return scraper.NewS3Sink(config), nil
+}
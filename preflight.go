@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+// The Conduit methods a scrape can't do without. Each entry is satisfied by any
+// one of its alternatives.
+var requiredMethods = [][]string{
+	{"macro.query", "macro.search"},
+	{"file.download"},
+}
+
+// check is the outcome of a single pre-flight check.
+type check struct {
+	name    string
+	detail  string // extra information about a passing check
+	err     error
+	skipped bool // because an earlier check it depends on failed
+}
+
+// Run the pre-flight checks for an instance, in order: that its output
+// directory is writable, that its host speaks Conduit, that the API token is
+// valid, and that the methods we need exist. The filesystem is checked before
+// any HTTP request is sent, and each Conduit check is skipped once one fails.
+// What's learned about the server is remembered by the instance's client.
+//
+// For a dry run, the directory is only checked to exist, since nothing may be
+// written. Creatable says whether a missing directory would be created.
+func preflight(inst instance, dryRun, creatable bool) []check {
+	var checks []check
+	switch {
+	case inst.dir == "":
+		// Archives are written to by every instance, so they're checked once
+		// they're opened rather than here.
+	case dryRun:
+		checks = append(checks, check{
+			name: fmt.Sprintf("output directory %s exists", inst.dir),
+			err:  testDir(inst.dir, creatable),
+		})
+	default:
+		checks = append(checks, check{
+			name: fmt.Sprintf("output directory %s is writable", inst.dir),
+			err:  testSink(inst.sink),
+		})
+	}
+
+	conduitChecks := []struct {
+		name string
+		run  func(*scraper.Client) (string, error)
+	}{
+		{inst.client.Host + " is a Conduit endpoint", checkEndpoint},
+		{"API token is valid", checkToken},
+		{"required Conduit methods are available", checkServer},
+	}
+
+	failed := len(checks) > 0 && checks[0].err != nil
+	for _, c := range conduitChecks {
+		if failed {
+			checks = append(checks, check{name: c.name, skipped: true})
+			continue
+		}
+		detail, err := c.run(inst.client)
+		checks = append(checks, check{name: c.name, detail: detail, err: err})
+		failed = err != nil
+	}
+
+	return checks
+}
+
+// Open a sink and write a test object to it just to see if we can. The object
+// is named so it can't clobber a macro's image.
+func testSink(sink scraper.Sink) error {
+	const probe = ".scrape-phabricator-macros-probe"
+	if err := sink.Open(); err != nil {
+		return err
+	}
+	w, err := sink.Put(probe)
+	if err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return sink.Delete(probe)
+}
+
+// Check without writing anything that a directory exists or, if it's one
+// we'd create, that its parent does.
+func testDir(dir string, creatable bool) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) && creatable {
+		dir = filepath.Dir(dir)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s isn't a directory", dir)
+	}
+	return nil
+}
+
+// conduit.ping doesn't require authentication, so any well-formed Conduit
+// response, even an error, shows that the host is a Conduit endpoint.
+func checkEndpoint(c *scraper.Client) (string, error) {
+	var result string
+	err := c.Call("conduit.ping", nil, &result)
+	if _, ok := err.(scraper.ConduitError); ok {
+		return "", nil
+	}
+	return "", err
+}
+
+func checkToken(c *scraper.Client) (string, error) {
+	var result struct {
+		UserName string `json:"userName"`
+	}
+	if err := c.Call("user.whoami", nil, &result); err != nil {
+		return "", err
+	}
+	return "authenticated as " + result.UserName, nil
+}
+
+func checkServer(c *scraper.Client) (string, error) {
+	server, err := c.DetectServer()
+	if err != nil {
+		return "", err
+	}
+
+	var missing []string
+	for _, alternatives := range requiredMethods {
+		found := false
+		for _, method := range alternatives {
+			found = found || server.Has(method)
+		}
+		if !found {
+			missing = append(missing, strings.Join(alternatives, " or "))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return server.String(), fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+
+	// Conduit tokens arrived in 2015; servers older than that can't use them.
+	if server.Authentication != nil && !contains(server.Authentication, "token") {
+		return server.String(), errors.New("server doesn't support API token authentication")
+	}
+	return server.String(), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Print the outcome of each check, returning whether they all passed.
+func printChecks(w io.Writer, host string, checks []check) bool {
+	ok := true
+	fmt.Fprintf(w, "Pre-flight checks for %s:\n", host)
+	for _, c := range checks {
+		switch {
+		case c.skipped:
+			fmt.Fprintf(w, "  [skip] %s\n", c.name)
+		case c.err != nil:
+			fmt.Fprintf(w, "  [FAIL] %s: %v\n", c.name, c.err)
+			ok = false
+		case c.detail != "":
+			fmt.Fprintf(w, "  [ ok ] %s (%s)\n", c.name, c.detail)
+		default:
+			fmt.Fprintf(w, "  [ ok ] %s\n", c.name)
+		}
+	}
+	return ok
+}
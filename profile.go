@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The config file holds named profiles in a small subset of TOML: one table per
+// profile, whose keys are the names of the command-line flags they set.
+//
+//	# ~/.config/scrape-phabricator-macros/config.toml
+//	[profiles.prod]
+//	host = "https://phab.example.com"
+//	keyCommand = "vault read -field=token secret/phab/prod"
+//	dir = "/srv/macros/prod"
+//	numConcurrentFetches = 20
+//	exclude = ["test*", "tmp*"]
+//
+// Strings, integers, booleans and single-line arrays are supported. Arrays are
+// joined with commas, which is how list-valued flags are written.
+type profiles map[string]map[string]string
+
+// Flags which are alternatives to one another: giving any of them on the
+// command line overrides all of them in the profile.
+var alternativeFlags = [][]string{{"key", "keyFile", "keyCommand"}}
+
+// The default config file location, e.g. ~/.config/scrape-phabricator-macros/
+// config.toml on Linux. Returns "" if there's no config directory.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "scrape-phabricator-macros", "config.toml")
+}
+
+// Apply the named profile from the config file to the flag set. Flags given
+// explicitly on the command line keep their values.
+func applyProfile(flags *flag.FlagSet, path, name string) error {
+	all, err := readProfiles(path)
+	if err != nil {
+		return err
+	}
+	profile, ok := all[name]
+	if !ok {
+		return fmt.Errorf("no profile %q in %s", name, path)
+	}
+
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, group := range alternativeFlags {
+		for _, name := range group {
+			if explicit[name] {
+				for _, alternative := range group {
+					explicit[alternative] = true
+				}
+				break
+			}
+		}
+	}
+
+	for key, value := range profile {
+		if key == "config" || key == "profile" || flags.Lookup(key) == nil {
+			return fmt.Errorf("profile %q in %s: unknown setting %q", name, path, key)
+		}
+		if explicit[key] {
+			continue
+		}
+		if err := flags.Set(key, value); err != nil {
+			return fmt.Errorf("profile %q in %s: invalid %s: %v", name, path, key, err)
+		}
+	}
+	return nil
+}
+
+func readProfiles(path string) (profiles, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		all     = make(profiles)
+		current map[string]string
+		scanner = bufio.NewScanner(f)
+		lineNum int
+	)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(splitUnquoted(scanner.Text(), '#')[0])
+		if line == "" {
+			continue
+		}
+
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", path, lineNum, fmt.Sprintf(format, args...))
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fail("unterminated table header")
+			}
+			header := strings.TrimSpace(line[1 : len(line)-1])
+			if !strings.HasPrefix(header, "profiles.") {
+				return nil, fail("unexpected table [%s]; expected [profiles.<name>]", header)
+			}
+			name, err := parseTOMLKey(strings.TrimPrefix(header, "profiles."))
+			if err != nil {
+				return nil, fail("%v", err)
+			}
+			// TOML doesn't allow a table to be defined twice.
+			if _, ok := all[name]; ok {
+				return nil, fail("profile %q is defined twice", name)
+			}
+			current = make(map[string]string)
+			all[name] = current
+			continue
+		}
+
+		if current == nil {
+			return nil, fail("setting outside of a [profiles.<name>] table")
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fail("expected key = value")
+		}
+		key, err := parseTOMLKey(strings.TrimSpace(line[:eq]))
+		if err != nil {
+			return nil, fail("%v", err)
+		}
+		value, err := parseTOMLValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fail("%s: %v", key, err)
+		}
+		if _, ok := current[key]; ok {
+			return nil, fail("%s is set twice", key)
+		}
+		current[key] = value
+	}
+
+	return all, scanner.Err()
+}
+
+func parseTOMLKey(key string) (string, error) {
+	if strings.HasPrefix(key, `"`) {
+		return strconv.Unquote(key)
+	}
+	if key == "" || strings.ContainsAny(key, " \t.\"'") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return key, nil
+}
+
+// Parse a TOML value into the string form flag.Value.Set expects.
+func parseTOMLValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return value[1 : len(value)-1], nil
+	case strings.HasPrefix(value, "["):
+		if !strings.HasSuffix(value, "]") {
+			return "", fmt.Errorf("arrays must be on a single line")
+		}
+		var items []string
+		for _, item := range splitUnquoted(value[1:len(value)-1], ',') {
+			// TOML allows a trailing comma after the last item.
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			parsed, err := parseTOMLValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, parsed)
+		}
+		return strings.Join(items, ","), nil
+	case value == "true" || value == "false":
+		return value, nil
+	default:
+		if _, err := strconv.ParseInt(strings.Replace(value, "_", "", -1), 0, 64); err != nil {
+			return "", fmt.Errorf("unsupported value %s", value)
+		}
+		return strings.Replace(value, "_", "", -1), nil
+	}
+}
+
+// Split s on sep, ignoring any occurrences of sep inside quoted strings.
+func splitUnquoted(s string, sep rune) []string {
+	var (
+		parts   []string
+		start   int
+		quote   rune
+		escaped bool
+	)
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == sep:
+			parts = append(parts, s[start:i])
+			start = i + len(string(r))
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Write a config file into a temporary directory, returning its path.
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadProfiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    profiles
+		wantErr string
+	}{
+		{
+			name: "every kind of value",
+			config: `
+[profiles.prod]
+host = "https://phab.example.com"
+keyCommand = 'vault read -field=token secret/phab'
+numConcurrentFetches = 1_000
+dryRun = true
+exclude = ["test*", 'tmp*',]
+`,
+			want: profiles{"prod": {
+				"host":                 "https://phab.example.com",
+				"keyCommand":           "vault read -field=token secret/phab",
+				"numConcurrentFetches": "1000",
+				"dryRun":               "true",
+				"exclude":              "test*,tmp*",
+			}},
+		},
+		{
+			name:   "escapes",
+			config: "[profiles.prod]\nuserAgent = \"say \\\"hi\\\"\\tthere\"\ndir = 'C:\\macros'\n",
+			want:   profiles{"prod": {"userAgent": "say \"hi\"\tthere", "dir": `C:\macros`}},
+		},
+		{
+			name: "comments",
+			config: `
+# Production.
+[profiles.prod] # the main one
+host = "https://phab.example.com/#macros" # not a comment in the string
+exclude = ["#*", "tmp*"] # nor in an array
+`,
+			want: profiles{"prod": {"host": "https://phab.example.com/#macros", "exclude": "#*,tmp*"}},
+		},
+		{
+			name:   "quoted names",
+			config: "[profiles.\"phab.example.com\"]\n\"dir\" = \"/srv/macros\"\n",
+			want:   profiles{"phab.example.com": {"dir": "/srv/macros"}},
+		},
+		{
+			name:   "several profiles",
+			config: "[profiles.prod]\ndir = \"prod\"\n\n[profiles.staging]\ndir = \"staging\"\n",
+			want:   profiles{"prod": {"dir": "prod"}, "staging": {"dir": "staging"}},
+		},
+		{
+			name:   "empty profile",
+			config: "[profiles.empty]\n",
+			want:   profiles{"empty": {}},
+		},
+		{name: "duplicate profile", config: "[profiles.prod]\n[profiles.prod]\n", wantErr: `:2: profile "prod" is defined twice`},
+		{name: "duplicate setting", config: "[profiles.prod]\ndir = \"a\"\ndir = \"b\"\n", wantErr: ":3: dir is set twice"},
+		{name: "other table", config: "[servers]\n", wantErr: ":1: unexpected table [servers]"},
+		{name: "unterminated header", config: "[profiles.prod\n", wantErr: ":1: unterminated table header"},
+		{name: "dotted profile name", config: "[profiles.prod.eu]\n", wantErr: `:1: invalid key "prod.eu"`},
+		{name: "setting outside a profile", config: "dir = \"a\"\n", wantErr: ":1: setting outside of a [profiles.<name>] table"},
+		{name: "no value", config: "[profiles.prod]\ndryRun\n", wantErr: ":2: expected key = value"},
+		{name: "key with a space", config: "[profiles.prod]\nkey file = \"a\"\n", wantErr: `:2: invalid key "key file"`},
+		{name: "unterminated string", config: "[profiles.prod]\ndir = \"/srv\n", wantErr: ":2: dir:"},
+		{name: "unterminated literal string", config: "[profiles.prod]\ndir = '/srv\n", wantErr: ":2: dir: unterminated string"},
+		{name: "multi-line array", config: "[profiles.prod]\nexclude = [\n", wantErr: ":2: exclude: arrays must be on a single line"},
+		{name: "float", config: "[profiles.prod]\ntimeout = 1.5\n", wantErr: ":2: timeout: unsupported value 1.5"},
+		{name: "bare word", config: "[profiles.prod]\ndir = srv\n", wantErr: ":2: dir: unsupported value srv"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readProfiles(writeConfig(t, test.config))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	config := `
+[profiles.prod]
+host = "https://phab.example.com"
+keyCommand = "vault read -field=token secret/phab"
+numConcurrentFetches = 20
+
+[profiles.typo]
+hots = "https://phab.example.com"
+
+[profiles.invalid]
+numConcurrentFetches = true
+
+[profiles.nested]
+profile = "prod"
+`
+	tests := []struct {
+		name    string
+		profile string
+		args    []string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "profile values",
+			profile: "prod",
+			want:    map[string]string{"host": "https://phab.example.com", "keyCommand": "vault read -field=token secret/phab", "numConcurrentFetches": "20"},
+		},
+		{
+			name:    "command line wins",
+			profile: "prod",
+			args:    []string{"-numConcurrentFetches=5"},
+			want:    map[string]string{"host": "https://phab.example.com", "numConcurrentFetches": "5"},
+		},
+		{
+			name:    "an alternative key source wins",
+			profile: "prod",
+			args:    []string{"-keyFile=/run/secrets/phab"},
+			want:    map[string]string{"keyCommand": "", "keyFile": "/run/secrets/phab"},
+		},
+		{name: "missing profile", profile: "dev", wantErr: `no profile "dev"`},
+		{name: "unknown setting", profile: "typo", wantErr: `profile "typo" in ` + "%s" + `: unknown setting "hots"`},
+		{name: "invalid value", profile: "invalid", wantErr: "invalid numConcurrentFetches"},
+		{name: "profiles can't select profiles", profile: "nested", wantErr: `unknown setting "profile"`},
+	}
+	path := writeConfig(t, config)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flags := flag.NewFlagSet("scrape", flag.ContinueOnError)
+			for _, name := range []string{"host", "key", "keyFile", "keyCommand", "profile"} {
+				flags.String(name, "", "")
+			}
+			flags.Int("numConcurrentFetches", 10, "")
+			if err := flags.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+
+			err := applyProfile(flags, path, test.profile)
+			if test.wantErr != "" {
+				want := strings.Replace(test.wantErr, "%s", path, 1)
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Fatalf("got error %v, want one containing %q", err, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range test.want {
+				if got := flags.Lookup(name).Value.String(); got != want {
+					t.Errorf("-%s is %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package scraper
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Archive formats an ArchiveSink can write.
+const (
+	FormatTar     = "tar"
+	FormatTarGzip = "tar.gz"
+	FormatZip     = "zip"
+)
+
+// The permissions of archives and of the files in them.
+const archiveFileMode = 0644
+
+// ArchiveFormat guesses an archive's format from its file name, e.g. "tar.gz"
+// for "macros.tgz", returning false if the extension isn't one it knows.
+func ArchiveFormat(name string) (string, bool) {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return FormatTarGzip, true
+	case strings.HasSuffix(lower, ".tar"):
+		return FormatTar, true
+	case strings.HasSuffix(lower, ".zip"):
+		return FormatZip, true
+	}
+	return "", false
+}
+
+// ArchiveSink is a Sink which streams objects into a tar, gzipped tar or zip
+// archive as they're written. Archives can only be appended to, so Delete
+// fails, and Exists only knows about objects written since the sink was
+// opened. An ArchiveSink is safe for concurrent use.
+type ArchiveSink struct {
+	format string
+	path   string    // of the archive file, if writing to one
+	w      io.Writer // otherwise
+
+	mu    sync.Mutex
+	file  *os.File // the temporary file being written, if any
+	gz    *gzip.Writer
+	tar   *tar.Writer
+	zip   *zip.Writer
+	names map[string]bool
+}
+
+// NewArchiveSink returns a sink which streams an archive in the given format
+// to w, e.g. os.Stdout. Closing the sink finishes the archive but leaves w
+// open.
+func NewArchiveSink(w io.Writer, format string) (*ArchiveSink, error) {
+	if err := checkFormat(format); err != nil {
+		return nil, err
+	}
+	return &ArchiveSink{format: format, w: w}, nil
+}
+
+// NewArchiveFileSink returns a sink which writes an archive in the given
+// format to a file. The archive is written under a temporary name and only
+// replaces the file once the sink is closed.
+func NewArchiveFileSink(path, format string) (*ArchiveSink, error) {
+	if err := checkFormat(format); err != nil {
+		return nil, err
+	}
+	return &ArchiveSink{format: format, path: path}, nil
+}
+
+func checkFormat(format string) error {
+	switch format {
+	case FormatTar, FormatTarGzip, FormatZip:
+		return nil
+	}
+	return fmt.Errorf("unknown archive format %q: expected tar, tar.gz or zip", format)
+}
+
+// Open starts the archive, creating its temporary file if writing to one.
+func (s *ArchiveSink) Open() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := s.w
+	if s.path != "" {
+		f, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp-")
+		if err != nil {
+			return err
+		}
+		s.file = f
+		w = f
+	}
+
+	switch s.format {
+	case FormatTarGzip:
+		s.gz = gzip.NewWriter(w)
+		s.tar = tar.NewWriter(s.gz)
+	case FormatTar:
+		s.tar = tar.NewWriter(w)
+	case FormatZip:
+		s.zip = zip.NewWriter(w)
+	}
+	s.names = make(map[string]bool)
+	return nil
+}
+
+// Put buffers the object, which is added to the archive once its writer is
+// closed, since a tar header needs the object's size up front.
+func (s *ArchiveSink) Put(name string) (io.WriteCloser, error) {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return nil, fmt.Errorf("invalid object name %q", name)
+	}
+	return &archiveEntry{sink: s, name: name}, nil
+}
+
+func (s *ArchiveSink) Exists(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.names[name], nil
+}
+
+func (s *ArchiveSink) Delete(name string) error {
+	return fmt.Errorf("can't delete %s: archives can only be appended to", name)
+}
+
+// Close finishes the archive and, if writing to a file, moves it into place.
+func (s *ArchiveSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	if s.tar != nil {
+		errs = append(errs, s.tar.Close())
+	}
+	if s.gz != nil {
+		errs = append(errs, s.gz.Close())
+	}
+	if s.zip != nil {
+		errs = append(errs, s.zip.Close())
+	}
+	if s.file != nil {
+		errs = append(errs, s.file.Close())
+		if err := errors.Join(errs...); err != nil {
+			os.Remove(s.file.Name())
+			return err
+		}
+		// Temporary files are only readable by their owner, which an
+		// archive meant for sharing shouldn't be.
+		errs = append(errs, os.Chmod(s.file.Name(), archiveFileMode), os.Rename(s.file.Name(), s.path))
+	}
+	return errors.Join(errs...)
+}
+
+// Add a complete object to the archive.
+func (s *ArchiveSink) add(name string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.names == nil {
+		return errors.New("archive isn't open")
+	}
+	switch {
+	case s.tar != nil:
+		err := s.tar.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    archiveFileMode,
+			Size:    int64(len(body)),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := s.tar.Write(body); err != nil {
+			return err
+		}
+	case s.zip != nil:
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()}
+		header.SetMode(archiveFileMode)
+		w, err := s.zip.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+	}
+	s.names[name] = true
+	return nil
+}
+
+// An object being written to an ArchiveSink.
+type archiveEntry struct {
+	bytes.Buffer
+	sink *ArchiveSink
+	name string
+}
+
+func (e *archiveEntry) Close() error {
+	return e.sink.add(e.name, e.Bytes())
+}
+
+// WithPrefix returns a view of sink which stores objects under a prefix, e.g.
+// "phab.example.com/", so several scrapes can share it. Opening and closing
+// the view does nothing: that's left to whoever owns the shared sink.
+func WithPrefix(sink Sink, prefix string) Sink {
+	return prefixSink{sink: sink, prefix: prefix}
+}
+
+type prefixSink struct {
+	sink   Sink
+	prefix string
+}
+
+func (s prefixSink) Open() error  { return nil }
+func (s prefixSink) Close() error { return nil }
+
+func (s prefixSink) Put(name string) (io.WriteCloser, error) { return s.sink.Put(s.prefix + name) }
+
+func (s prefixSink) Exists(name string) (bool, error) { return s.sink.Exists(s.prefix + name) }
+
+func (s prefixSink) Delete(name string) error { return s.sink.Delete(s.prefix + name) }
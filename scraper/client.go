@@ -0,0 +1,255 @@
+package scraper
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	liburl "net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Client calls the Conduit API of a single Phabricator or Phorge instance. A
+// Client is safe for concurrent use.
+type Client struct {
+	// Host is the instance's base URL, e.g. "https://phab.example.com", to
+	// which "/api/<method>" is appended.
+	Host string
+	// Token is the Conduit API token to authenticate with.
+	Token string
+	// HTTP is the client requests are sent with, or http.DefaultClient if nil.
+	HTTP *http.Client
+	// UserAgent is sent as the User-Agent header of every request, if set.
+	UserAgent string
+	// Logger receives a debug-level record of every call, if set.
+	Logger *slog.Logger
+	// Observe, if set, is called as each Conduit call starts. The function it
+	// returns is called when the call ends with the HTTP status, or 0 if no
+	// response arrived, and the number of bytes in the response body.
+	Observe func(method string) func(status int, bytes int64)
+	// Retries is how many times a call is retried when the server is
+	// overloaded or failing, as shown by an HTTP 429 or 5xx status. Each retry
+	// waits twice as long as the last, starting from RetryWait (a second if
+	// unset), or as long as the server asks with Retry-After, up to a minute.
+	Retries   int
+	RetryWait time.Duration
+	// OnRetry, if set, is called before each retry with the error prompting it.
+	OnRetry func(method string, err error)
+
+	mu     sync.Mutex
+	server *ServerInfo // once detected
+}
+
+// ConduitError is an error reported by a Conduit method itself, such as
+// ERR-INVALID-AUTH for a bad API token.
+type ConduitError struct {
+	Method, Code, Info string
+}
+
+func (e ConduitError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Method, e.Code, e.Info)
+}
+
+// The envelope every Conduit method's response comes wrapped in.
+type conduitResponse struct {
+	Result    json.RawMessage `json:"result"`
+	ErrorCode *string         `json:"error_code"`
+	ErrorInfo *string         `json:"error_info"`
+}
+
+func (c *Client) log() *slog.Logger {
+	if c.Logger == nil {
+		return slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return c.Logger
+}
+
+// Send a GET request to the specified URL through the client's HTTP client.
+func (c *Client) get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(req)
+}
+
+// Return the url for a GET request to the specified Phabricator API method.
+func (c *Client) methodURL(apiMethod string, params map[string]string) string {
+	return c.urlWithToken(c.Host+"/api/"+apiMethod, params)
+}
+
+// Given a raw URL string and arbitrary query params, add the client's API token
+// to the params in the proper key and return the full encoded URL.
+func (c *Client) urlWithToken(url string, params map[string]string) string {
+	values := liburl.Values{"api.token": []string{c.Token}}
+	for key, val := range params {
+		values[key] = []string{val}
+	}
+	return fmt.Sprintf("%s?%s", url, values.Encode())
+}
+
+// Call calls the specified Conduit method and decodes its result into the
+// value pointed to by result, turning Conduit's error codes into ConduitErrors.
+// Calls the server turns away as overloaded or failing are retried, up to
+// c.Retries times.
+func (c *Client) Call(method string, params map[string]string, result interface{}) error {
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		done := func(int, int64) {}
+		if c.Observe != nil {
+			done = c.Observe(method)
+		}
+		outcome, err := c.doCall(method, params, result)
+		done(outcome.status, outcome.bytes)
+
+		attrs := []interface{}{
+			"method", method,
+			"duration", time.Since(start),
+			"status", outcome.status,
+			"bytes", outcome.bytes,
+		}
+		if err != nil {
+			attrs = append(attrs, "error", err)
+		}
+		c.log().Debug("conduit call", attrs...)
+
+		retryable := outcome.status == http.StatusTooManyRequests || outcome.status >= 500
+		if err == nil || !retryable || attempt >= c.Retries {
+			return err
+		}
+
+		wait := c.retryWait(attempt, outcome.retryAfter)
+		c.log().Warn("retrying conduit call", "method", method, "wait", wait, "error", err)
+		if c.OnRetry != nil {
+			c.OnRetry(method, err)
+		}
+		time.Sleep(wait)
+	}
+}
+
+// The longest a retry waits, however long the server asks for.
+const maxRetryWait = time.Minute
+
+// How long to wait before a call's next retry: as long as the
+// server asked, or else exponentially longer each time.
+func (c *Client) retryWait(attempt int, retryAfter time.Duration) time.Duration {
+	wait := c.RetryWait
+	if wait <= 0 {
+		wait = time.Second
+	}
+	for i := 0; i < attempt && wait < maxRetryWait; i++ {
+		wait *= 2
+	}
+	if retryAfter > 0 {
+		wait = retryAfter
+	}
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	return wait
+}
+
+// What a Conduit call's HTTP response said about it, besides its result.
+type callOutcome struct {
+	status     int   // or 0 if no response arrived
+	bytes      int64 // in the response body
+	retryAfter time.Duration
+}
+
+// Make a Conduit call, returning how the HTTP response went alongside any
+// error.
+func (c *Client) doCall(method string, params map[string]string, result interface{}) (callOutcome, error) {
+	resp, err := c.get(c.methodURL(method, params))
+	if err != nil {
+		// Errors from the HTTP client quote the URL, which holds the API token.
+		if urlErr, ok := err.(*liburl.Error); ok {
+			urlErr.URL = RedactURL(urlErr.URL)
+		}
+		return callOutcome{}, err
+	}
+	defer resp.Body.Close()
+
+	var (
+		payload conduitResponse
+		body    = &countingReader{r: resp.Body}
+	)
+	err = json.NewDecoder(body).Decode(&payload)
+	outcome := callOutcome{status: resp.StatusCode, bytes: body.n}
+	if seconds, parseErr := strconv.Atoi(resp.Header.Get("Retry-After")); parseErr == nil && seconds > 0 {
+		outcome.retryAfter = time.Duration(seconds) * time.Second
+	}
+	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return outcome, fmt.Errorf("%s: unexpected HTTP status %s", method, resp.Status)
+		}
+		return outcome, fmt.Errorf("%s: response isn't Conduit JSON: %v", method, err)
+	}
+
+	if payload.ErrorCode != nil {
+		e := ConduitError{Method: method, Code: *payload.ErrorCode}
+		if payload.ErrorInfo != nil {
+			e.Info = *payload.ErrorInfo
+		}
+		return outcome, e
+	}
+
+	if err := json.Unmarshal(payload.Result, result); err != nil {
+		return outcome, fmt.Errorf("%s: unexpected result: %v", method, err)
+	}
+	return outcome, nil
+}
+
+// RedactURL replaces the API token in a URL so it can be shown to humans.
+func RedactURL(url string) string {
+	u, err := liburl.Parse(url)
+	if err != nil {
+		return url
+	}
+	query := u.Query()
+	if query.Get("api.token") != "" {
+		query.Set("api.token", "REDACTED")
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// Download retrieves a macro's image.
+func (c *Client) Download(macro Macro) (Image, error) {
+	// Oddly, images from the file.download endpoint come as base64-encoded
+	// strings, so we'll need to decode those before writing the bytes to disk.
+	var result string
+	err := c.Call("file.download", map[string]string{"phid": macro.FilePHID}, &result)
+	if err != nil {
+		return Image{}, err
+	}
+
+	body, err := base64.StdEncoding.DecodeString(result)
+	if err != nil {
+		return Image{}, err
+	}
+
+	return Image{Macro: macro, Body: body}, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,257 @@
+package scraper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server flavors whose differences the client knows about.
+const (
+	FlavorPhabricator = "Phabricator"
+	FlavorPhorge      = "Phorge"
+)
+
+// Conduit API versions. Neither Phabricator nor Phorge reports its release
+// over Conduit, so a server's version is the generation of API it offers:
+// legacy servers only have the older *.query methods, while modern ones have
+// the *.search methods that replaced them.
+const (
+	VersionLegacy = "legacy"
+	VersionModern = "modern"
+)
+
+// ServerInfo describes the flavor of a Conduit server, its API version and
+// the methods it offers, so the client can pick endpoints and response shapes
+// it understands.
+type ServerInfo struct {
+	Flavor  string
+	Version string
+	Methods map[string]bool
+	// The authentication schemes from conduit.getcapabilities, e.g. "token",
+	// or nil if the server is too old to say.
+	Authentication []string
+}
+
+// Has reports whether the server offers a Conduit method.
+func (s ServerInfo) Has(method string) bool { return s.Methods[method] }
+
+// Describe the server for humans, e.g. "Phorge (modern API), 142 methods".
+func (s ServerInfo) String() string {
+	return fmt.Sprintf("%s (%s API), %d methods", s.Flavor, s.Version, len(s.Methods))
+}
+
+// DetectServer finds out what kind of server the client is talking to, and
+// remembers it so later calls use methods the server has.
+func (c *Client) DetectServer() (ServerInfo, error) {
+	var methods map[string]struct {
+		Description string `json:"description"`
+	}
+	if err := c.Call("conduit.query", nil, &methods); err != nil {
+		return ServerInfo{}, err
+	}
+
+	info := ServerInfo{Version: VersionLegacy, Methods: make(map[string]bool)}
+	var descriptions []string
+	for name, method := range methods {
+		info.Methods[name] = true
+		descriptions = append(descriptions, method.Description)
+		if strings.HasSuffix(name, ".search") {
+			info.Version = VersionModern
+		}
+	}
+	info.Flavor = detectFlavor(descriptions)
+
+	// Very old releases predate conduit.getcapabilities, in which case we just
+	// don't know which authentication schemes are supported.
+	if info.Has("conduit.getcapabilities") {
+		var capabilities struct {
+			Authentication []string `json:"authentication"`
+		}
+		if err := c.Call("conduit.getcapabilities", nil, &capabilities); err != nil {
+			return ServerInfo{}, err
+		}
+		info.Authentication = capabilities.Authentication
+	}
+
+	c.mu.Lock()
+	c.server = &info
+	c.mu.Unlock()
+	return info, nil
+}
+
+// Matches the product names a method description can mention.
+var productNamePattern = regexp.MustCompile(`\b(` + FlavorPhabricator + `|` + FlavorPhorge + `)\b`)
+
+// Tell Phorge from Phabricator by their method descriptions. Phorge is a fork
+// of Phabricator that names itself in its user-facing strings wherever
+// Phabricator did, so its descriptions mention Phorge rather than
+// Phabricator. Any one description may mention the other product, e.g. one
+// from an extension written for both, so the name mentioned most wins, and a
+// server that names neither is taken to be Phabricator.
+func detectFlavor(descriptions []string) string {
+	counts := make(map[string]int)
+	for _, description := range descriptions {
+		for _, name := range productNamePattern.FindAllString(description, -1) {
+			counts[name]++
+		}
+	}
+	if counts[FlavorPhorge] > counts[FlavorPhabricator] {
+		return FlavorPhorge
+	}
+	return FlavorPhabricator
+}
+
+// Return what's known about the server, detecting it if it hasn't been yet.
+func (c *Client) serverInfo() (ServerInfo, error) {
+	c.mu.Lock()
+	server := c.server
+	c.mu.Unlock()
+	if server != nil {
+		return *server, nil
+	}
+	return c.DetectServer()
+}
+
+// ListMacros retrieves every macro on the instance, with macro.search where the
+// server has it and otherwise with macro.query.
+func (c *Client) ListMacros() ([]Macro, error) {
+	server, err := c.serverInfo()
+	if err != nil {
+		return nil, err
+	}
+	if server.Has("macro.search") {
+		return c.searchMacros()
+	}
+	return c.queryMacros()
+}
+
+// The fields of a macro as macro.query returns them.
+type macroQueryResult struct {
+	Name        string          `json:"name"`
+	FilePHID    string          `json:"filePHID"`
+	AuthorPHID  string          `json:"authorPHID"`
+	DateCreated conduitDateTime `json:"dateCreated"`
+}
+
+func (r macroQueryResult) macro(name string) Macro {
+	if name == "" {
+		name = r.Name
+	}
+	return Macro{
+		Name:       name,
+		FilePHID:   r.FilePHID,
+		AuthorPHID: r.AuthorPHID,
+		Created:    time.Time(r.DateCreated),
+	}
+}
+
+// macro.query has returned both an object keyed by macro name and, on some
+// releases, a list of macros which carry their own name. Accept either.
+func (c *Client) queryMacros() ([]Macro, error) {
+	var result json.RawMessage
+	if err := c.Call("macro.query", nil, &result); err != nil {
+		return nil, err
+	}
+
+	var macros []Macro
+	switch trimmed := bytes.TrimSpace(result); {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		var byName map[string]macroQueryResult
+		if err := json.Unmarshal(trimmed, &byName); err != nil {
+			return nil, fmt.Errorf("macro.query: unexpected result: %v", err)
+		}
+		for name, r := range byName {
+			macros = append(macros, r.macro(name))
+		}
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		var list []macroQueryResult
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, fmt.Errorf("macro.query: unexpected result: %v", err)
+		}
+		for _, r := range list {
+			macros = append(macros, r.macro(""))
+		}
+	case bytes.Equal(trimmed, []byte("null")):
+		// No macros at all.
+	default:
+		return nil, errors.New("macro.query: result is neither an object nor a list")
+	}
+
+	return macros, nil
+}
+
+func (c *Client) searchMacros() ([]Macro, error) {
+	var macros []Macro
+	err := c.searchAll("macro.search", nil, func(phid string, fields json.RawMessage) error {
+		var r macroQueryResult
+		if err := json.Unmarshal(fields, &r); err != nil {
+			return err
+		}
+		macros = append(macros, r.macro(""))
+		return nil
+	})
+	return macros, err
+}
+
+// Page through the results of one of the modern *.search methods, calling each
+// with the PHID and fields of every object found. Params are sent as given, so
+// constraints are written out, e.g. "constraints[phids][0]".
+func (c *Client) searchAll(
+	method string,
+	params map[string]string,
+	each func(phid string, fields json.RawMessage) error,
+) error {
+	query := make(map[string]string, len(params)+1)
+	for key, val := range params {
+		query[key] = val
+	}
+
+	for {
+		var result struct {
+			Data []struct {
+				PHID   string          `json:"phid"`
+				Fields json.RawMessage `json:"fields"`
+			} `json:"data"`
+			Cursor struct {
+				After *string `json:"after"`
+			} `json:"cursor"`
+		}
+		if err := c.Call(method, query, &result); err != nil {
+			return err
+		}
+
+		for _, object := range result.Data {
+			if err := each(object.PHID, object.Fields); err != nil {
+				return fmt.Errorf("%s: unexpected result for %s: %v", method, object.PHID, err)
+			}
+		}
+
+		if result.Cursor.After == nil || *result.Cursor.After == "" {
+			return nil
+		}
+		query["after"] = *result.Cursor.After
+	}
+}
+
+// conduitDateTime is a Unix timestamp, which Conduit sends as a number from
+// *.search methods and as a string from older methods such as macro.query.
+type conduitDateTime time.Time
+
+func (t *conduitDateTime) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		return nil
+	}
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %s", data)
+	}
+	*t = conduitDateTime(time.Unix(seconds, 0))
+	return nil
+}
@@ -0,0 +1,225 @@
+package scraper
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serve recorded Conduit responses: each method named in responses gets the
+// contents of its file under testdata, and any other method is unknown.
+func newReplayServer(t *testing.T, responses map[string]string) *httptest.Server {
+	t.Helper()
+	bodies := make(map[string][]byte)
+	for method, name := range responses {
+		body, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies[method] = body
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := strings.TrimPrefix(r.URL.Path, "/api/")
+		body, ok := bodies[method]
+		if !ok {
+			body = []byte(`{"result":null,"error_code":"ERR-CONDUIT-CALL","error_info":"Conduit method \"` +
+				method + `\" does not exist."}`)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// The macros in every recorded listing.
+var recordedMacros = []Macro{
+	{
+		Name:       "party",
+		FilePHID:   "PHID-FILE-dv2n6qfmmkkgn5k4qrzl",
+		AuthorPHID: "PHID-USER-xwvj2x3b7mnaxy2zdkwa",
+		Created:    time.Unix(1497545563, 0),
+	},
+	{
+		Name:       "shipit",
+		FilePHID:   "PHID-FILE-u3f2qf7vhzkeutcnyfye",
+		AuthorPHID: "PHID-USER-fkxs6wxy2atgsfsexkxv",
+		Created:    time.Unix(1498219327, 0),
+	},
+}
+
+func TestServerCompatibility(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses map[string]string // files under testdata, by method
+		flavor    string
+		version   string
+		listWith  string // the method ListMacros should use
+		want      []Macro
+	}{
+		{
+			name: "Phabricator 2017, macro.query object",
+			responses: map[string]string{
+				"conduit.query":           "phabricator-2017/conduit.query.json",
+				"conduit.getcapabilities": "phabricator-2017/conduit.getcapabilities.json",
+				"macro.query":             "phabricator-2017/macro.query.json",
+			},
+			flavor:   FlavorPhabricator,
+			version:  VersionLegacy,
+			listWith: "macro.query",
+			want:     recordedMacros,
+		},
+		{
+			name: "Phabricator 2017, macro.query list",
+			responses: map[string]string{
+				"conduit.query":           "phabricator-2017/conduit.query.json",
+				"conduit.getcapabilities": "phabricator-2017/conduit.getcapabilities.json",
+				"macro.query":             "phabricator-2017/macro.query-list.json",
+			},
+			flavor:   FlavorPhabricator,
+			version:  VersionLegacy,
+			listWith: "macro.query",
+			want:     recordedMacros,
+		},
+		{
+			name: "Phabricator 2017, no macros",
+			responses: map[string]string{
+				"conduit.query":           "phabricator-2017/conduit.query.json",
+				"conduit.getcapabilities": "phabricator-2017/conduit.getcapabilities.json",
+				"macro.query":             "phabricator-2017/macro.query-null.json",
+			},
+			flavor:   FlavorPhabricator,
+			version:  VersionLegacy,
+			listWith: "macro.query",
+		},
+		{
+			name: "Phabricator 2023",
+			responses: map[string]string{
+				"conduit.query":           "phabricator-2023/conduit.query.json",
+				"conduit.getcapabilities": "phabricator-2023/conduit.getcapabilities.json",
+				"macro.search":            "phabricator-2023/macro.search.json",
+			},
+			flavor:   FlavorPhabricator,
+			version:  VersionModern,
+			listWith: "macro.search",
+			want:     recordedMacros,
+		},
+		{
+			name: "Phorge 2024",
+			responses: map[string]string{
+				"conduit.query":           "phorge-2024/conduit.query.json",
+				"conduit.getcapabilities": "phorge-2024/conduit.getcapabilities.json",
+				"macro.search":            "phorge-2024/macro.search.json",
+			},
+			flavor:   FlavorPhorge,
+			version:  VersionModern,
+			listWith: "macro.search",
+			want:     recordedMacros,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newReplayServer(t, test.responses)
+			client := &Client{Host: server.URL, Token: "api-test"}
+
+			info, err := client.DetectServer()
+			if err != nil {
+				t.Fatalf("DetectServer: %v", err)
+			}
+			if info.Flavor != test.flavor || info.Version != test.version {
+				t.Errorf("detected %s with a %s API, want %s with a %s API", info.Flavor, info.Version, test.flavor, test.version)
+			}
+			if !info.Has(test.listWith) {
+				t.Errorf("%s not among the methods detected: %v", test.listWith, info)
+			}
+			if len(info.Authentication) == 0 || info.Authentication[0] != "token" {
+				t.Errorf("authentication schemes are %v, want token first", info.Authentication)
+			}
+
+			macros, err := client.ListMacros()
+			if err != nil {
+				t.Fatalf("ListMacros: %v", err)
+			}
+			sort.Slice(macros, func(i, j int) bool { return macros[i].Name < macros[j].Name })
+			if len(macros) != len(test.want) {
+				t.Fatalf("listed %+v, want %+v", macros, test.want)
+			}
+			for i, m := range macros {
+				want := test.want[i]
+				if m.Name != want.Name || m.FilePHID != want.FilePHID || m.AuthorPHID != want.AuthorPHID ||
+					!m.Created.Equal(want.Created) {
+					t.Errorf("listed %+v, want %+v", m, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectFlavor(t *testing.T) {
+	tests := []struct {
+		name         string
+		descriptions []string
+		want         string
+	}{
+		{"no product named", []string{"Download a file from the server.", "Query macros."}, FlavorPhabricator},
+		{"Phabricator", []string{"Basic ping for monitoring or a health-check of this Phabricator install."}, FlavorPhabricator},
+		{"Phorge", []string{"Basic ping for monitoring or a health-check of this Phorge install."}, FlavorPhorge},
+		{
+			"Phorge with an extension naming Phabricator",
+			[]string{
+				"Returns the parameters of the Phorge Conduit methods.",
+				"Basic ping for monitoring or a health-check of this Phorge install.",
+				"Sync tasks from Phabricator or Phorge.",
+			},
+			FlavorPhorge,
+		},
+		{
+			"Phabricator with an extension naming Phorge",
+			[]string{
+				"Returns the parameters of the Phabricator Conduit methods.",
+				"Sync tasks from Phabricator or Phorge.",
+			},
+			FlavorPhabricator,
+		},
+		{"only within other words", []string{"Query the Phorgery.", "List Phorgeable things."}, FlavorPhabricator},
+	}
+	for _, test := range tests {
+		if got := detectFlavor(test.descriptions); got != test.want {
+			t.Errorf("%s: detected %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestConduitDateTime(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    time.Time
+		wantErr bool
+	}{
+		{json: `"1497545563"`, want: time.Unix(1497545563, 0)},
+		{json: `1497545563`, want: time.Unix(1497545563, 0)},
+		{json: `null`},
+		{json: `""`},
+		{json: `"yesterday"`, wantErr: true},
+		{json: `1497545563.5`, wantErr: true},
+	}
+	for _, test := range tests {
+		var got struct {
+			Date conduitDateTime `json:"date"`
+		}
+		err := json.Unmarshal([]byte(`{"date": `+test.json+`}`), &got)
+		if (err != nil) != test.wantErr {
+			t.Errorf("unmarshalling %s: got error %v, want error: %v", test.json, err, test.wantErr)
+			continue
+		}
+		if !time.Time(got.Date).Equal(test.want) {
+			t.Errorf("unmarshalling %s gave %v, want %v", test.json, time.Time(got.Date), test.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package scraper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Ways a Scraper can store images with identical contents only once, as a blob
+// named after their SHA-256.
+const (
+	// DedupeHardlink makes each macro's name a hard link to its blob.
+	DedupeHardlink = "hardlink"
+	// DedupeSymlink makes each macro's name a symbolic link to its blob.
+	DedupeSymlink = "symlink"
+	// DedupeManifest stores only the blobs, and records which blob is each
+	// macro's in the manifest.
+	DedupeManifest = "manifest"
+)
+
+// Linker is implemented by sinks which can make one object a link to another.
+type Linker interface {
+	// Link makes name refer to the existing object target, replacing any
+	// object of that name, with a symbolic link if symbolic is set and a hard
+	// link otherwise.
+	Link(target, name string, symbolic bool) error
+}
+
+// BlobName is the name an image with the given SHA-256 is stored under when
+// deduplicating, e.g. "blobs/ab/ab12...".
+func BlobName(sha string) string {
+	return "blobs/" + sha[:2] + "/" + sha
+}
+
+// WithDedupe stores images with identical contents once, in the given way:
+// DedupeHardlink, DedupeSymlink or DedupeManifest. Linking needs a sink which
+// implements Linker, such as DirSink.
+func WithDedupe(mode string) Option {
+	return func(s *Scraper) { s.dedupe = mode }
+}
+
+// Check that the sink can store images the way the Scraper dedupes them.
+func (s *Scraper) checkDedupe() error {
+	switch s.dedupe {
+	case "", DedupeManifest:
+		return nil
+	case DedupeHardlink, DedupeSymlink:
+		if _, ok := s.sink.(Linker); !ok {
+			return fmt.Errorf("the sink can't make links for %s dedupe", s.dedupe)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown dedupe mode %q: expected hardlink, symlink or manifest", s.dedupe)
+}
+
+// Write an image's blob unless it's already in the sink, and link the macro's
+// name to it. Returns the name the image can be found under and its blob.
+func (s *Scraper) writeDeduped(image Image, name string) (string, string, error) {
+	sum := sha256.Sum256(image.Body)
+	blob := BlobName(hex.EncodeToString(sum[:]))
+
+	if !s.blobs[blob] {
+		exists, err := s.sink.Exists(blob)
+		if err != nil {
+			return "", "", err
+		}
+		if !exists {
+			if err := WriteObject(s.sink, blob, image.Body); err != nil {
+				return "", "", err
+			}
+		}
+		s.blobs[blob] = true
+	}
+
+	if s.dedupe == DedupeManifest {
+		return blob, blob, nil
+	}
+	if err := s.sink.(Linker).Link(blob, name, s.dedupe == DedupeSymlink); err != nil {
+		return "", "", err
+	}
+	return name, blob, nil
+}
+
+// Link makes a link under a temporary name and renames it into place, so an
+// existing file of that name is replaced atomically. Symbolic links are
+// relative, so the directory can be moved.
+func (s *DirSink) Link(target, name string, symbolic bool) error {
+	if err := s.checkName(target); err != nil {
+		return err
+	}
+	if err := s.checkName(name); err != nil {
+		return err
+	}
+	path := s.Path(name)
+	if err := os.MkdirAll(filepath.Dir(path), s.dirMode); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(
+		filepath.Dir(path),
+		"."+filepath.Base(path)+".link-"+strconv.FormatInt(time.Now().UnixNano(), 36),
+	)
+	var err error
+	if symbolic {
+		var rel string
+		if rel, err = filepath.Rel(filepath.Dir(path), s.Path(target)); err == nil {
+			err = os.Symlink(rel, tmp)
+		}
+	} else {
+		err = os.Link(s.Path(target), tmp)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// DuplicateGroups returns the names of the macros in a manifest that share an
+// image, keyed by the image's SHA-256. Each group is sorted by name.
+func DuplicateGroups(m *Manifest) map[string][]string {
+	bySHA := make(map[string][]string)
+	for _, entry := range m.Macros {
+		bySHA[entry.SHA256] = append(bySHA[entry.SHA256], entry.Name)
+	}
+	for sha, names := range bySHA {
+		if len(names) < 2 {
+			delete(bySHA, sha)
+			continue
+		}
+		sort.Strings(names)
+	}
+	return bySHA
+}
@@ -0,0 +1,61 @@
+package scraper
+
+import (
+	"fmt"
+	"path"
+	"slices"
+)
+
+// Filter selects macros by name using shell-style glob patterns, e.g.
+// "party*". A macro is kept if it matches any include pattern (or there are
+// none) and no exclude pattern, and, if any authors are given, was created by
+// one of them.
+type Filter struct {
+	Include, Exclude []string
+	// Usernames or PHIDs. Matching usernames relies on FillAuthors having
+	// been called.
+	Authors []string
+}
+
+// Validate checks that every pattern is well-formed, so a typo is reported up
+// front rather than silently matching nothing.
+func (f Filter) Validate() error {
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Match reports whether the filter keeps a macro.
+func (f Filter) Match(m Macro) bool {
+	if len(f.Include) > 0 && !matchAny(f.Include, m.Name) {
+		return false
+	}
+	if len(f.Authors) > 0 && !slices.Contains(f.Authors, m.AuthorPHID) &&
+		(m.AuthorName == "" || !slices.Contains(f.Authors, m.AuthorName)) {
+		return false
+	}
+	return !matchAny(f.Exclude, m.Name)
+}
+
+// Apply returns the macros the filter keeps, in their original order.
+func (f Filter) Apply(macros []Macro) []Macro {
+	var kept []Macro
+	for _, m := range macros {
+		if f.Match(m) {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package scraper
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultLayout is the layout images are stored in unless told otherwise:
+// flat, each named after its macro.
+const DefaultLayout = "{{.Name}}.gif"
+
+// Layout decides the name each macro's image is stored under in a sink, from
+// a text/template evaluated with LayoutFields, e.g.
+// "{{.Author}}/{{.Name}}.{{.Ext}}" or "{{.Created.Year}}/{{.Name}}.gif".
+type Layout struct {
+	text string
+	tmpl *template.Template
+}
+
+// LayoutFields are what a Layout's template can refer to.
+type LayoutFields struct {
+	Name       string
+	Ext        string // the image's format, e.g. "gif" or "png"
+	Author     string // the author's username, or their PHID if it's unknown
+	AuthorName string // the author's real name, if known
+	AuthorPHID string
+	FilePHID   string
+	Created    time.Time
+}
+
+// ParseLayout parses a layout template, checking that it can be evaluated.
+func ParseLayout(text string) (*Layout, error) {
+	tmpl, err := template.New("layout").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid layout: %v", err)
+	}
+	l := &Layout{text: text, tmpl: tmpl}
+	example := Macro{
+		Name:       "example",
+		FilePHID:   "PHID-FILE-example",
+		AuthorPHID: "PHID-USER-example",
+		AuthorName: "example",
+		Created:    time.Now(),
+	}
+	if _, err := l.Name(example, nil); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Layout) String() string { return l.text }
+
+// Name returns the name a macro's image is stored under. The image's format
+// is detected from its body, or assumed to be GIF if there isn't one yet.
+func (l *Layout) Name(m Macro, body []byte) (string, error) {
+	fields := LayoutFields{
+		Name:       m.Name,
+		Ext:        imageExt(body),
+		Author:     m.AuthorPHID,
+		AuthorName: m.AuthorRealName,
+		AuthorPHID: m.AuthorPHID,
+		FilePHID:   m.FilePHID,
+		Created:    m.Created,
+	}
+	if m.AuthorName != "" {
+		fields.Author = m.AuthorName
+	}
+	var b bytes.Buffer
+	if err := l.tmpl.Execute(&b, fields); err != nil {
+		return "", fmt.Errorf("invalid layout: %v", err)
+	}
+
+	name := path.Clean(strings.TrimSpace(b.String()))
+	switch {
+	case !filepath.IsLocal(filepath.FromSlash(name)):
+		return "", fmt.Errorf("layout gives %q for %s, which isn't a relative path", b.String(), m.Name)
+	case name == ManifestName, strings.HasPrefix(name, "blobs/"):
+		return "", fmt.Errorf("layout gives %q for %s, which is reserved", name, m.Name)
+	}
+	return name, nil
+}
+
+// The file extension for an image's format.
+func imageExt(body []byte) string {
+	if len(body) == 0 {
+		return "gif"
+	}
+	switch http.DetectContentType(body) {
+	case "image/png":
+		return "png"
+	case "image/jpeg":
+		return "jpg"
+	case "image/webp":
+		return "webp"
+	case "image/bmp":
+		return "bmp"
+	}
+	return "gif"
+}
+
+// WithLayout stores images under the names l gives them rather than
+// DefaultLayout. Two macros given the same name is an error for the second.
+func WithLayout(l *Layout) Option {
+	return func(s *Scraper) { s.layout = l }
+}
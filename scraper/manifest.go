@@ -0,0 +1,81 @@
+package scraper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// ManifestName is the name a scrape's manifest is written under in its sink.
+const ManifestName = "manifest.json"
+
+// The version of the manifest's format, bumped whenever a field is removed or
+// changes meaning.
+const manifestVersion = 1
+
+// Manifest records the macros a scrape wrote to a sink and where, so that
+// tools reading the sink needn't guess at its layout.
+type Manifest struct {
+	Version   int             `json:"version"`
+	Host      string          `json:"host"`
+	Generated time.Time       `json:"generated"`
+	Macros    []ManifestEntry `json:"macros"` // sorted by name
+}
+
+// ManifestEntry describes a single macro in a Manifest.
+type ManifestEntry struct {
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`           // the object name in the sink
+	Blob       string    `json:"blob,omitempty"` // the deduplicated image Path refers to, if any
+	FilePHID   string    `json:"filePHID"`
+	AuthorPHID string    `json:"authorPHID,omitempty"`
+	Author     string    `json:"author,omitempty"`     // the author's username
+	AuthorName string    `json:"authorName,omitempty"` // and real name
+	Created    time.Time `json:"created"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+}
+
+// Describe an image written to a sink under the given name.
+func manifestEntry(image Image, name string) ManifestEntry {
+	sum := sha256.Sum256(image.Body)
+	return ManifestEntry{
+		Name:       image.Name,
+		Path:       name,
+		FilePHID:   image.FilePHID,
+		AuthorPHID: image.AuthorPHID,
+		Author:     image.AuthorName,
+		AuthorName: image.AuthorRealName,
+		Created:    image.Created,
+		Size:       int64(len(image.Body)),
+		SHA256:     hex.EncodeToString(sum[:]),
+	}
+}
+
+// ReadManifest decodes a manifest, e.g. one opened from a DirSink's directory.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if m.Version > manifestVersion {
+		return nil, fmt.Errorf("manifest version %d is newer than this program understands", m.Version)
+	}
+	return &m, nil
+}
+
+// Write sorts the manifest's entries and writes it to a sink as ManifestName.
+func (m *Manifest) Write(sink Sink) error {
+	m.Version = manifestVersion
+	sort.Slice(m.Macros, func(i, j int) bool { return m.Macros[i].Name < m.Macros[j].Name })
+
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteObject(sink, ManifestName, append(body, '\n'))
+}
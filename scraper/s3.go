@@ -0,0 +1,433 @@
+package scraper
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	liburl "net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The smallest part S3 accepts in a multipart upload, other than the last.
+const s3MinPartSize = 5 << 20
+
+// S3Config describes where an S3Sink writes and how it authenticates.
+type S3Config struct {
+	// Endpoint is the base URL of the S3-compatible service, e.g.
+	// "http://localhost:9000" for MinIO. It defaults to AWS's endpoint for
+	// the region.
+	Endpoint string
+	// Region is the region requests are signed for, "us-east-1" by default.
+	Region string
+	// Bucket and Prefix say where objects go: an object named "party.gif"
+	// with the prefix "macros/" is stored under the key "macros/party.gif".
+	Bucket, Prefix string
+	// PathStyle addresses the bucket as part of the URL's path rather than
+	// its host name, as most S3-compatible services other than AWS require.
+	PathStyle bool
+	// The credentials to sign requests with. SessionToken is only needed for
+	// temporary credentials.
+	AccessKeyID, SecretAccessKey, SessionToken string
+	// PartSize is the size of the parts objects larger than it are uploaded
+	// in, 16 MiB by default and no less than 5 MiB.
+	PartSize int64
+	// HTTP is the client requests are sent with, or http.DefaultClient if nil.
+	HTTP *http.Client
+}
+
+// S3Sink is a Sink which uploads objects to an S3-compatible bucket. Each
+// object's SHA-256 is stored in its metadata, so uploading an object that
+// hasn't changed is skipped. An S3Sink is safe for concurrent use.
+type S3Sink struct {
+	config S3Config
+}
+
+// NewS3Sink returns a sink which uploads to the bucket described by config.
+func NewS3Sink(config S3Config) *S3Sink {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	config.Endpoint = strings.TrimRight(config.Endpoint, "/")
+	if config.PartSize == 0 {
+		config.PartSize = 16 << 20
+	} else if config.PartSize < s3MinPartSize {
+		config.PartSize = s3MinPartSize
+	}
+	if config.HTTP == nil {
+		config.HTTP = http.DefaultClient
+	}
+	return &S3Sink{config: config}
+}
+
+// s3Error is an error response from S3, e.g. NoSuchBucket.
+type s3Error struct {
+	op      string
+	status  string
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%s: unexpected HTTP status %s", e.op, e.status)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.op, e.Code, e.Message)
+}
+
+// Open checks that the bucket exists and the credentials can reach it.
+func (s *S3Sink) Open() error {
+	resp, err := s.do("HEAD", "", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &s3Error{op: "HEAD bucket " + s.config.Bucket, status: resp.Status}
+	}
+	return nil
+}
+
+// Put buffers the object, which is uploaded once its writer is closed.
+// Refuse names which aren't plain relative paths, as a DirSink refuses those
+// which would escape its directory. Keys are just strings to S3, but ".." and
+// empty segments still mean something to anything that syncs the bucket to
+// disk.
+func (s *S3Sink) checkName(name string) error {
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("invalid object name %q", name)
+		}
+	}
+	return nil
+}
+
+func (s *S3Sink) Put(name string) (io.WriteCloser, error) {
+	if err := s.checkName(name); err != nil {
+		return nil, err
+	}
+	return &s3Object{sink: s, key: s.config.Prefix + name}, nil
+}
+
+func (s *S3Sink) Exists(name string) (bool, error) {
+	if err := s.checkName(name); err != nil {
+		return false, err
+	}
+	_, exists, err := s.head(s.config.Prefix + name)
+	return exists, err
+}
+
+func (s *S3Sink) Delete(name string) error {
+	if err := s.checkName(name); err != nil {
+		return err
+	}
+	key := s.config.Prefix + name
+	resp, err := s.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return readS3Error("DELETE "+key, resp)
+	}
+	return nil
+}
+
+// Close does nothing, since every object is uploaded once its writer is
+// closed.
+func (s *S3Sink) Close() error { return nil }
+
+// Look up an object, returning the SHA-256 stored in its metadata.
+func (s *S3Sink) head(key string) (sha string, exists bool, err error) {
+	resp, err := s.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return "", false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get("X-Amz-Meta-Sha256"), true, nil
+	case http.StatusNotFound:
+		return "", false, nil
+	}
+	return "", false, &s3Error{op: "HEAD " + key, status: resp.Status}
+}
+
+// Upload an object, unless one with the same contents is already there.
+func (s *S3Sink) upload(key string, body []byte) error {
+	sum := sha256.Sum256(body)
+	sha := hex.EncodeToString(sum[:])
+	if existing, _, err := s.head(key); err != nil {
+		return err
+	} else if existing == sha {
+		return nil
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", contentType(key, body))
+	header.Set("X-Amz-Meta-Sha256", sha)
+
+	if int64(len(body)) <= s.config.PartSize {
+		resp, err := s.do("PUT", key, nil, header, body)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return readS3Error("PUT "+key, resp)
+		}
+		return nil
+	}
+	return s.uploadMultipart(key, header, body)
+}
+
+// The content type of an object: JSON for the manifest, and otherwise
+// whatever its contents look like, e.g. image/gif.
+func contentType(key string, body []byte) string {
+	if path.Ext(key) == ".json" {
+		return "application/json"
+	}
+	return http.DetectContentType(body)
+}
+
+// Upload a large object in parts, aborting the upload if any part fails so
+// the bucket isn't left holding orphaned parts.
+func (s *S3Sink) uploadMultipart(key string, header http.Header, body []byte) error {
+	resp, err := s.do("POST", key, liburl.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readS3Error("CreateMultipartUpload "+key, resp)
+	}
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return fmt.Errorf("CreateMultipartUpload %s: %v", key, err)
+	}
+
+	if err := s.uploadParts(key, created.UploadID, body); err != nil {
+		if resp, abortErr := s.do("DELETE", key, liburl.Values{"uploadId": {created.UploadID}}, nil, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *S3Sink) uploadParts(key, uploadID string, body []byte) error {
+	var parts []s3CompletedPart
+	for start, number := int64(0), 1; start < int64(len(body)); start, number = start+s.config.PartSize, number+1 {
+		end := start + s.config.PartSize
+		if end > int64(len(body)) {
+			end = int64(len(body))
+		}
+		query := liburl.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := s.do("PUT", key, query, nil, body[start:end])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return &s3Error{op: fmt.Sprintf("UploadPart %d of %s", number, key), status: resp.Status}
+		}
+		parts = append(parts, s3CompletedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	}
+
+	complete, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := s.do("POST", key, liburl.Values{"uploadId": {uploadID}}, nil, complete)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// S3 can report a failure to complete the upload in the body of a 200.
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || bytes.Contains(respBody, []byte("<Error>")) {
+		e := &s3Error{op: "CompleteMultipartUpload " + key, status: resp.Status}
+		xml.Unmarshal(respBody, e)
+		return e
+	}
+	return nil
+}
+
+func readS3Error(op string, resp *http.Response) error {
+	e := &s3Error{op: op, status: resp.Status}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(body, e)
+	return e
+}
+
+// The URL of an object, or of the bucket if key is empty.
+func (s *S3Sink) url(key string, query liburl.Values) (*liburl.URL, error) {
+	u, err := liburl.Parse(s.config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if s.config.PathStyle {
+		u.Path += "/" + s.config.Bucket
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	u.Path += "/" + key
+	u.RawPath = u.Path[:len(u.Path)-len(key)] + s3Escape(key, false)
+	u.RawQuery = canonicalQuery(query)
+	return u, nil
+}
+
+// Send a request signed with AWS Signature Version 4.
+func (s *S3Sink) do(method, key string, query liburl.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := s.url(key, query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.config.HTTP.Do(req)
+}
+
+// Sign a request, as described at
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3Sink) sign(req *http.Request, body []byte, now time.Time) {
+	payloadSum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payloadSum[:])
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+
+	// Sign the host, content type and every x-amz-* header.
+	signed := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			signed[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestSum := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestSum[:])
+
+	key := []byte("AWS4" + s.config.SecretAccessKey)
+	for _, part := range []string{date, s.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Encode a query string the way Signature Version 4 expects: sorted by key,
+// with every character but the unreserved ones escaped.
+func canonicalQuery(query liburl.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// Percent-encode everything but unreserved characters and, unless escaping a
+// query component, slashes.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// An object being written to an S3Sink.
+type s3Object struct {
+	bytes.Buffer
+	sink *S3Sink
+	key  string
+}
+
+func (o *s3Object) Close() error {
+	return o.sink.upload(o.key, o.Bytes())
+}
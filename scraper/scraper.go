@@ -0,0 +1,377 @@
+// Package scraper mirrors the image macros of a Phabricator or Phorge
+// instance. A Client talks to the instance's Conduit API, and a Scraper uses
+// one to list the macros, filter them, download their images concurrently and
+// write each image to a Sink and hand it to its hooks, or yield them one at a
+// time from an Iterator.
+package scraper
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultConcurrency is how many images a Scraper downloads at once unless
+// told otherwise.
+const DefaultConcurrency = 50
+
+// Macro is an image macro: its name and file PHID (Phabricator ID), along
+// with who created it and when.
+type Macro struct {
+	Name       string
+	FilePHID   string
+	AuthorPHID string
+	Created    time.Time
+	Size       int64 // of the image in bytes, or 0 if unknown
+
+	// The author's username and real name, once FillAuthors has looked them
+	// up, or "" if it hasn't or couldn't.
+	AuthorName, AuthorRealName string
+}
+
+// Image is a macro with its image's contents.
+type Image struct {
+	Macro
+	Body []byte
+}
+
+// Scraper downloads the images of an instance's macros. Its hooks are called
+// from a single goroutine, one at a time, so they needn't synchronize with
+// each other.
+type Scraper struct {
+	client      *Client
+	sink        Sink
+	manifest    *Manifest // of the images written, if one was asked for
+	dedupe      string
+	layout      *Layout
+	users       *UserCache
+	names       map[string]string // macro names by object name, during a Run
+	blobs       map[string]bool   // written or found in the sink during this Run
+	filter      Filter
+	concurrency int
+
+	onList  func(listed int, selected []Macro) error
+	onMacro func(Macro) error
+	onImage func(Image) error
+	onWrite func(image Image, name string)
+	onError func(Macro, error)
+}
+
+// Option configures a Scraper.
+type Option func(*Scraper)
+
+// New returns a Scraper which downloads images through client.
+func New(client *Client, options ...Option) *Scraper {
+	s := &Scraper{client: client, concurrency: DefaultConcurrency}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// WithConcurrency sets how many images are downloaded at once.
+func WithConcurrency(n int) Option {
+	return func(s *Scraper) {
+		if n > 0 {
+			s.concurrency = n
+		}
+	}
+}
+
+// WithSink writes each image Run downloads to sink, under its ObjectName. The
+// caller opens the sink beforehand and closes it afterwards.
+func WithSink(sink Sink) Option {
+	return func(s *Scraper) { s.sink = sink }
+}
+
+// WithManifest makes Run write a Manifest of the images it wrote to the sink
+// once they've all been written.
+func WithManifest() Option {
+	return func(s *Scraper) { s.manifest = &Manifest{} }
+}
+
+// WithFilter limits the scrape to the macros f matches.
+func WithFilter(f Filter) Option {
+	return func(s *Scraper) { s.filter = f }
+}
+
+// OnList calls fn once the macros have been listed and filtered and their
+// sizes looked up, with the number listed and those selected. Returning an
+// error stops the scrape before any image is downloaded.
+func OnList(fn func(listed int, selected []Macro) error) Option {
+	return func(s *Scraper) { s.onList = fn }
+}
+
+// OnMacro calls fn with each selected macro before its image is downloaded.
+// Returning an error skips the macro; the error goes no further.
+func OnMacro(fn func(Macro) error) Option {
+	return func(s *Scraper) { s.onMacro = fn }
+}
+
+// OnImage calls fn with each image downloaded by Run, before it's written to
+// the sink. An error it returns stops the image being written and is passed on
+// to the OnError hook, unless it's ErrSkip.
+func OnImage(fn func(Image) error) Option {
+	return func(s *Scraper) { s.onImage = fn }
+}
+
+// OnWrite calls fn with each image written to the sink, and the name it was
+// written under.
+func OnWrite(fn func(image Image, name string)) Option {
+	return func(s *Scraper) { s.onWrite = fn }
+}
+
+// OnError calls fn with each macro whose image couldn't be downloaded or
+// handled, and why.
+func OnError(fn func(Macro, error)) Option {
+	return func(s *Scraper) { s.onError = fn }
+}
+
+// Run scrapes the instance, returning an error only if the scrape couldn't
+// start or its manifest couldn't be written. Failures to download individual
+// images go to the OnError hook.
+func (s *Scraper) Run() error {
+	if err := s.checkDedupe(); err != nil {
+		return err
+	}
+	s.blobs = make(map[string]bool)
+	s.names = make(map[string]string)
+	if s.manifest != nil {
+		*s.manifest = Manifest{}
+	}
+	if err := s.run(nil, s.handleImage); err != nil {
+		return err
+	}
+	if s.manifest != nil && s.sink != nil {
+		s.manifest.Host = s.client.Host
+		s.manifest.Generated = time.Now().UTC()
+		if err := s.manifest.Write(s.sink); err != nil {
+			return fmt.Errorf("failed to write manifest: %v", err)
+		}
+	}
+	return nil
+}
+
+// Pass an image to the OnImage hook, then write it to the sink.
+func (s *Scraper) handleImage(image Image) error {
+	if s.onImage != nil {
+		if err := s.onImage(image); err != nil {
+			return err
+		}
+	}
+	if s.sink == nil {
+		return nil
+	}
+	name, err := s.objectName(image)
+	if err != nil {
+		return err
+	}
+	blob := ""
+	if s.dedupe != "" {
+		if name, blob, err = s.writeDeduped(image, name); err != nil {
+			return err
+		}
+	} else if err := WriteObject(s.sink, name, image.Body); err != nil {
+		return err
+	}
+	if s.manifest != nil {
+		entry := manifestEntry(image, name)
+		entry.Blob = blob
+		s.manifest.Macros = append(s.manifest.Macros, entry)
+	}
+	if s.onWrite != nil {
+		s.onWrite(image, name)
+	}
+	return nil
+}
+
+// The name an image is stored under, which mustn't be another macro's.
+func (s *Scraper) objectName(image Image) (string, error) {
+	if s.layout == nil {
+		return ObjectName(image.Macro), nil
+	}
+	name, err := s.layout.Name(image.Macro, image.Body)
+	if err != nil {
+		return "", err
+	}
+	if other, ok := s.names[name]; ok && other != image.Name {
+		return "", fmt.Errorf("layout gives %s, which %s is already stored as", name, other)
+	}
+	s.names[name] = image.Name
+	return name, nil
+}
+
+// Manifest returns the manifest of the images written by the last Run, if the
+// Scraper was made with WithManifest.
+func (s *Scraper) Manifest() *Manifest { return s.manifest }
+
+// A downloaded image, or why it couldn't be.
+type result struct {
+	image Image
+	err   error
+}
+
+// List lists the instance's macros and looks up their authors and sizes as a
+// scrape would, returning every macro listed along with those the filter
+// selects. It downloads nothing and calls none of the hooks, so it tells a
+// dry run exactly what Run would go on to fetch.
+func (s *Scraper) List() (listed, selected []Macro, err error) {
+	listed, err = s.client.ListMacros()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch macros: %v", err)
+	}
+
+	// Authors are looked up before filtering so they can be filtered by.
+	// Without a filter on them, their names are only nice to have.
+	if s.users != nil || len(s.filter.Authors) > 0 {
+		if err := s.client.FillAuthors(listed, s.users); err != nil {
+			if len(s.filter.Authors) > 0 {
+				return nil, nil, fmt.Errorf("failed to look up authors: %v", err)
+			}
+			s.client.log().Warn("failed to look up authors", "error", err)
+		}
+	}
+	selected = s.filter.Apply(listed)
+
+	// Sizes let the OnList hook budget for the scrape, but they're only an
+	// estimate, so failing to look them up isn't fatal.
+	if err := s.client.FillSizes(selected, s.concurrency); err != nil {
+		s.client.log().Warn("failed to look up file sizes", "error", err)
+	}
+	return listed, selected, nil
+}
+
+// Scrape the instance, handing each image to onImage until done is closed.
+func (s *Scraper) run(done <-chan struct{}, onImage func(Image) error) error {
+	listed, macros, err := s.List()
+	if err != nil {
+		return err
+	}
+	if s.onList != nil {
+		if err := s.onList(len(listed), macros); err != nil {
+			return err
+		}
+	}
+
+	var queue []Macro
+	for _, m := range macros {
+		if s.onMacro != nil && s.onMacro(m) != nil {
+			continue
+		}
+		queue = append(queue, m)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		pending = make(chan Macro)
+		results = make(chan result)
+	)
+
+	// Start as many goroutines fetching images as the concurrency allows.
+	for i := 0; i < s.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range pending {
+				image, err := s.client.Download(m)
+				if err != nil {
+					image.Macro = m
+				}
+				results <- result{image: image, err: err}
+			}
+		}()
+	}
+
+	// Queue the macros up for retrieval, stopping early if we're done, and
+	// close the results once every fetch has finished.
+	go func() {
+	queueing:
+		for _, m := range queue {
+			select {
+			case pending <- m:
+			case <-done:
+				break queueing
+			}
+		}
+		close(pending)
+		wg.Wait()
+		close(results)
+	}()
+
+	for r := range results {
+		select {
+		case <-done:
+			// Drain the fetches already under way.
+			continue
+		default:
+		}
+		if r.err == nil && onImage != nil {
+			r.err = onImage(r.image)
+		}
+		if r.err != nil && !errors.Is(r.err, ErrSkip) && s.onError != nil {
+			s.onError(r.image.Macro, r.err)
+		}
+	}
+	return nil
+}
+
+// Iterator yields a scrape's images one at a time:
+//
+//	images := s.Images()
+//	defer images.Close()
+//	for images.Next() {
+//		image := images.Image()
+//		...
+//	}
+//	if err := images.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	images    chan Image
+	done      chan struct{}
+	closeOnce sync.Once
+	image     Image
+	err       error
+}
+
+// Images starts scraping the instance in the background, returning an
+// Iterator over the images downloaded. Images it yields aren't written to the
+// sink or passed to the OnImage and OnWrite hooks; the other hooks are called
+// as they are by Run.
+func (s *Scraper) Images() *Iterator {
+	it := &Iterator{images: make(chan Image), done: make(chan struct{})}
+	go func() {
+		it.err = s.run(it.done, func(image Image) error {
+			select {
+			case it.images <- image:
+			case <-it.done:
+			}
+			return nil
+		})
+		close(it.images)
+	}()
+	return it
+}
+
+// Next waits for the next image, returning false once there are no more.
+func (it *Iterator) Next() bool {
+	image, ok := <-it.images
+	if ok {
+		it.image = image
+	}
+	return ok
+}
+
+// Image returns the image found by the last call to Next.
+func (it *Iterator) Image() Image { return it.image }
+
+// Err returns why the scrape couldn't start, if it couldn't, once Next has
+// returned false.
+func (it *Iterator) Err() error { return it.err }
+
+// Close stops the scrape early. Downloads already under way are finished but
+// their images are discarded.
+func (it *Iterator) Close() {
+	it.closeOnce.Do(func() { close(it.done) })
+}
@@ -0,0 +1,515 @@
+package scraper_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tedkornish/scrape-phabricator-macros/conduittest"
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+const token = "api-test"
+
+// The macros every test server starts with, keyed by name.
+var testImages = map[string]string{
+	"cat":   "GIF89a cat",
+	"party": "GIF89a party",
+	"shrug": "GIF89a shrug",
+}
+
+// Start a fake Conduit API holding testImages, authored by alice except for
+// shrug, whose author is bob.
+func newTestServer(t *testing.T) *conduittest.Server {
+	t.Helper()
+	server := conduittest.NewServer(token)
+	t.Cleanup(server.Close)
+	server.AddUser(conduittest.User{PHID: "PHID-USER-bob", UserName: "bob", RealName: "Bob Example"})
+	for name, data := range testImages {
+		author := "PHID-USER-alice"
+		if name == "shrug" {
+			author = "PHID-USER-bob"
+		}
+		server.AddMacro(conduittest.Macro{Name: name, Data: []byte(data), AuthorPHID: author})
+	}
+	return server
+}
+
+func newTestClient(server *conduittest.Server) *scraper.Client {
+	return &scraper.Client{Host: server.URL, Token: token}
+}
+
+// Open a DirSink on a fresh directory.
+func newTestSink(t *testing.T) *scraper.DirSink {
+	t.Helper()
+	sink := scraper.NewDirSink(t.TempDir())
+	if err := sink.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+// Collect the macros the OnError hook is called with, and why.
+type errorLog struct {
+	mu     sync.Mutex
+	errors map[string]error
+}
+
+func (l *errorLog) hook() scraper.Option {
+	l.errors = make(map[string]error)
+	return scraper.OnError(func(m scraper.Macro, err error) {
+		l.mu.Lock()
+		l.errors[m.Name] = err
+		l.mu.Unlock()
+	})
+}
+
+// Read the files in a DirSink's directory, by name.
+func readSink(t *testing.T, sink *scraper.DirSink) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(sink.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		body, err := os.ReadFile(filepath.Join(sink.Dir(), entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(body)
+	}
+	return files
+}
+
+func readManifest(t *testing.T, sink *scraper.DirSink) *scraper.Manifest {
+	t.Helper()
+	f, err := os.Open(sink.Path(scraper.ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	manifest, err := scraper.ReadManifest(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*conduittest.Server)
+		listWith  string // the method the macros should be listed with
+	}{
+		{"Phabricator", func(*conduittest.Server) {}, "macro.search"},
+		{"Phorge", func(s *conduittest.Server) { s.SetPhorge(true) }, "macro.search"},
+		{"paged", func(s *conduittest.Server) { s.SetPageSize(1) }, "macro.search"},
+		{"without macro.search", func(s *conduittest.Server) { s.RemoveMethod("macro.search") }, "macro.query"},
+		{"macro.query list", func(s *conduittest.Server) {
+			s.RemoveMethod("macro.search")
+			s.SetMacroList(true)
+		}, "macro.query"},
+		{"without file.search", func(s *conduittest.Server) { s.RemoveMethod("file.search") }, "macro.search"},
+		{"without user.search", func(s *conduittest.Server) { s.RemoveMethod("user.search") }, "macro.search"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t)
+			test.configure(server)
+			sink := newTestSink(t)
+
+			var (
+				listed   int
+				selected []scraper.Macro
+				written  = make(map[string]string)
+				errs     errorLog
+			)
+			s := scraper.New(
+				newTestClient(server),
+				scraper.WithSink(sink),
+				scraper.WithManifest(),
+				scraper.WithAuthors(nil),
+				scraper.OnList(func(n int, macros []scraper.Macro) error {
+					listed, selected = n, macros
+					return nil
+				}),
+				scraper.OnWrite(func(image scraper.Image, name string) { written[image.Name] = name }),
+				errs.hook(),
+			)
+			if err := s.Run(); err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if len(errs.errors) > 0 {
+				t.Errorf("OnError called with %v", errs.errors)
+			}
+			if server.Requests(test.listWith) == 0 {
+				t.Errorf("macros weren't listed with %s", test.listWith)
+			}
+
+			if listed != len(testImages) || len(selected) != len(testImages) {
+				t.Errorf("OnList got %d listed and %d selected, want %d of each", listed, len(selected), len(testImages))
+			}
+			for _, m := range selected {
+				if want := int64(len(testImages[m.Name])); m.Size != want {
+					t.Errorf("%s listed with size %d, want %d", m.Name, m.Size, want)
+				}
+			}
+
+			files := readSink(t, sink)
+			for name, data := range testImages {
+				if written[name] != name+".gif" {
+					t.Errorf("%s written as %q, want %q", name, written[name], name+".gif")
+				}
+				if files[name+".gif"] != data {
+					t.Errorf("%s.gif holds %q, want %q", name, files[name+".gif"], data)
+				}
+			}
+			if len(files) != len(testImages)+1 {
+				t.Errorf("sink holds %d files, want the images and the manifest", len(files))
+			}
+
+			manifest := readManifest(t, sink)
+			if manifest.Host != server.URL {
+				t.Errorf("manifest host is %q, want %q", manifest.Host, server.URL)
+			}
+			var names []string
+			for _, entry := range manifest.Macros {
+				names = append(names, entry.Name)
+				if entry.Path != entry.Name+".gif" || entry.Size != int64(len(testImages[entry.Name])) {
+					t.Errorf("manifest entry %+v doesn't describe %s.gif", entry, entry.Name)
+				}
+				wantAuthor := "alice"
+				if entry.Name == "shrug" {
+					wantAuthor = "bob"
+				}
+				if entry.Author != wantAuthor {
+					t.Errorf("manifest gives %s's author as %q, want %q", entry.Name, entry.Author, wantAuthor)
+				}
+			}
+			if got := strings.Join(names, ","); got != "cat,party,shrug" {
+				t.Errorf("manifest lists %s, want cat,party,shrug", got)
+			}
+		})
+	}
+}
+
+func TestRunFilter(t *testing.T) {
+	server := newTestServer(t)
+	sink := newTestSink(t)
+
+	s := scraper.New(
+		newTestClient(server),
+		scraper.WithSink(sink),
+		scraper.WithManifest(),
+		scraper.WithFilter(scraper.Filter{Exclude: []string{"p*"}, Authors: []string{"alice"}}),
+	)
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	manifest := readManifest(t, sink)
+	if len(manifest.Macros) != 1 || manifest.Macros[0].Name != "cat" {
+		t.Errorf("manifest lists %+v, want only cat", manifest.Macros)
+	}
+	if _, err := os.Stat(sink.Path("party.gif")); !os.IsNotExist(err) {
+		t.Errorf("excluded party.gif was written: %v", err)
+	}
+}
+
+func TestRunDownloadFailure(t *testing.T) {
+	server := newTestServer(t)
+	server.FailMethod("file.download", "ERR-BAD-PHID", "No such file exists.")
+	sink := newTestSink(t)
+
+	var errs errorLog
+	s := scraper.New(newTestClient(server), scraper.WithSink(sink), scraper.WithManifest(), errs.hook())
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if len(errs.errors) != len(testImages) {
+		t.Errorf("OnError called for %d macros, want %d", len(errs.errors), len(testImages))
+	}
+	for name, err := range errs.errors {
+		var conduitErr scraper.ConduitError
+		if !errors.As(err, &conduitErr) || conduitErr.Code != "ERR-BAD-PHID" {
+			t.Errorf("%s failed with %v, want ERR-BAD-PHID", name, err)
+		}
+	}
+	if files := readSink(t, sink); len(files) != 1 {
+		t.Errorf("sink holds %v, want only the manifest", files)
+	}
+	if macros := readManifest(t, sink).Macros; len(macros) != 0 {
+		t.Errorf("manifest lists %+v, want nothing", macros)
+	}
+}
+
+func TestRunSkip(t *testing.T) {
+	server := newTestServer(t)
+	sink := newTestSink(t)
+
+	var errs errorLog
+	s := scraper.New(
+		newTestClient(server),
+		scraper.WithSink(sink),
+		scraper.OnMacro(func(m scraper.Macro) error {
+			if m.Name == "cat" {
+				return errors.New("not this one")
+			}
+			return nil
+		}),
+		scraper.OnImage(func(image scraper.Image) error {
+			if image.Name == "party" {
+				return scraper.ErrSkip
+			}
+			return nil
+		}),
+		errs.hook(),
+	)
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if len(errs.errors) > 0 {
+		t.Errorf("OnError called with %v", errs.errors)
+	}
+	if files := readSink(t, sink); len(files) != 1 || files["shrug.gif"] == "" {
+		t.Errorf("sink holds %v, want only shrug.gif", files)
+	}
+	if got := server.Requests("file.download"); got != 2 {
+		t.Errorf("%d images downloaded, want 2", got)
+	}
+}
+
+func TestRunMalformed(t *testing.T) {
+	server := newTestServer(t)
+	server.MalformMethod("macro.search")
+	sink := newTestSink(t)
+
+	s := scraper.New(newTestClient(server), scraper.WithSink(sink), scraper.WithManifest())
+	err := s.Run()
+	if err == nil || !strings.Contains(err.Error(), "isn't Conduit JSON") {
+		t.Fatalf("Run returned %v, want an error about the malformed listing", err)
+	}
+	if files := readSink(t, sink); len(files) != 0 {
+		t.Errorf("sink holds %v after a failed listing, want nothing", files)
+	}
+
+	// Sizes are only an estimate, so garbled file metadata doesn't stop the
+	// scrape.
+	server.Reset()
+	server.MalformMethod("file.search")
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run with malformed file.search: %v", err)
+	}
+	if macros := readManifest(t, sink).Macros; len(macros) != len(testImages) {
+		t.Errorf("manifest lists %d macros, want %d", len(macros), len(testImages))
+	}
+}
+
+func TestRunRateLimited(t *testing.T) {
+	server := newTestServer(t)
+	server.SetRateLimit(2, 50*time.Millisecond)
+	sink := newTestSink(t)
+
+	var (
+		mu      sync.Mutex
+		retries int
+	)
+	client := newTestClient(server)
+	client.Retries = 10
+	client.RetryWait = 10 * time.Millisecond
+	client.OnRetry = func(string, error) {
+		mu.Lock()
+		retries++
+		mu.Unlock()
+	}
+
+	var errs errorLog
+	s := scraper.New(client, scraper.WithSink(sink), scraper.WithManifest(), errs.hook())
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(errs.errors) > 0 {
+		t.Errorf("OnError called with %v", errs.errors)
+	}
+	if retries == 0 {
+		t.Error("no calls were retried")
+	}
+	if macros := readManifest(t, sink).Macros; len(macros) != len(testImages) {
+		t.Errorf("manifest lists %d macros, want %d", len(macros), len(testImages))
+	}
+
+	// Without retries, the first call over the limit fails the scrape.
+	server.SetRateLimit(1, time.Hour)
+	err := scraper.New(newTestClient(server), scraper.WithSink(newTestSink(t))).Run()
+	if err == nil || !strings.Contains(err.Error(), "ERR-RATE-LIMIT") {
+		t.Errorf("Run returned %v, want ERR-RATE-LIMIT", err)
+	}
+}
+
+func TestImages(t *testing.T) {
+	server := newTestServer(t)
+	sink := newTestSink(t)
+
+	images := scraper.New(newTestClient(server), scraper.WithSink(sink)).Images()
+	defer images.Close()
+	var names []string
+	for images.Next() {
+		image := images.Image()
+		if string(image.Body) != testImages[image.Name] {
+			t.Errorf("%s has body %q, want %q", image.Name, image.Body, testImages[image.Name])
+		}
+		names = append(names, image.Name)
+	}
+	if err := images.Err(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, ","); got != "cat,party,shrug" {
+		t.Errorf("yielded %s, want cat,party,shrug", got)
+	}
+	if files := readSink(t, sink); len(files) != 0 {
+		t.Errorf("sink holds %v, want nothing written by Images", files)
+	}
+}
+
+func TestImagesClose(t *testing.T) {
+	server := newTestServer(t)
+
+	images := scraper.New(newTestClient(server), scraper.WithConcurrency(1)).Images()
+	if !images.Next() {
+		t.Fatalf("no images yielded: %v", images.Err())
+	}
+	images.Close()
+	for images.Next() {
+		// Images already downloaded may still arrive; the scrape must end.
+	}
+	if err := images.Err(); err != nil {
+		t.Errorf("Err: %v", err)
+	}
+}
+
+func TestImagesListFailure(t *testing.T) {
+	server := newTestServer(t)
+	server.FailMethod("macro.search", "ERR-CONDUIT-CORE", "The database is on fire.")
+
+	images := scraper.New(newTestClient(server)).Images()
+	defer images.Close()
+	if images.Next() {
+		t.Fatalf("yielded %s despite the listing failing", images.Image().Name)
+	}
+	if err := images.Err(); err == nil || !strings.Contains(err.Error(), "ERR-CONDUIT-CORE") {
+		t.Errorf("Err returned %v, want ERR-CONDUIT-CORE", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	server := newTestServer(t)
+	server.FailMethod("file.search", "ERR-CONDUIT-CORE", "The database is on fire.")
+
+	s := scraper.New(newTestClient(server), scraper.WithFilter(scraper.Filter{Include: []string{"party"}}))
+	listed, selected, err := s.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(listed) != len(testImages) {
+		t.Errorf("listed %d macros, want %d", len(listed), len(testImages))
+	}
+	// Failing to look up sizes leaves them unknown rather than failing.
+	if len(selected) != 1 || selected[0].Name != "party" || selected[0].Size != 0 {
+		t.Errorf("selected %+v, want party of unknown size", selected)
+	}
+	if got := server.Requests("file.download"); got != 0 {
+		t.Errorf("List downloaded %d images", got)
+	}
+}
+
+func TestFillAuthorsCache(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(server)
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	// Fill in the authors of a macro by alice and one by an account that
+	// can't be found, with the cache as it is on disk, returning how many
+	// times user.search was called.
+	fill := func() int {
+		t.Helper()
+		cache, err := scraper.LoadUserCache(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := server.Requests("user.search")
+		macros := []scraper.Macro{
+			{Name: "cat", AuthorPHID: "PHID-USER-alice"},
+			{Name: "ghost", AuthorPHID: "PHID-USER-ghost"},
+		}
+		if err := client.FillAuthors(macros, cache); err != nil {
+			t.Fatalf("FillAuthors: %v", err)
+		}
+		if macros[0].AuthorName != "alice" || macros[0].AuthorRealName != "Alice Example" {
+			t.Errorf("cat's author is %q (%q), want alice", macros[0].AuthorName, macros[0].AuthorRealName)
+		}
+		if macros[1].AuthorName != "" {
+			t.Errorf("ghost's author is %q, want none", macros[1].AuthorName)
+		}
+		if err := cache.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return server.Requests("user.search") - before
+	}
+
+	if n := fill(); n != 1 {
+		t.Fatalf("looked users up %d times, want once", n)
+	}
+	if n := fill(); n != 0 {
+		t.Errorf("looked users up %d times with both cached, want none", n)
+	}
+
+	// After a couple of days, the miss has expired but alice hasn't.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		entry["fetched"] = time.Now().Add(-48 * time.Hour)
+	}
+	if data, err = json.Marshal(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if n := fill(); n != 1 {
+		t.Errorf("looked users up %d times once the miss expired, want once", n)
+	}
+
+	// Only the miss was looked up again.
+	if data, err = os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	var refreshed map[string]struct {
+		Fetched time.Time `json:"fetched"`
+		Missing bool      `json:"missing"`
+	}
+	if err := json.Unmarshal(data, &refreshed); err != nil {
+		t.Fatal(err)
+	}
+	for key, entry := range refreshed {
+		recent := time.Since(entry.Fetched) < time.Hour
+		if strings.HasSuffix(key, "PHID-USER-ghost") != (recent && entry.Missing) {
+			t.Errorf("%s cached as %+v", key, entry)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package scraper
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Sink is a destination for scraped images. Objects in a sink are named by
+// slash-separated paths relative to its root, e.g. "party.gif".
+type Sink interface {
+	// Open prepares the sink to receive objects.
+	Open() error
+	// Put returns a writer for the named object, replacing any object of
+	// that name. The object is only complete once the writer has been closed
+	// without error.
+	Put(name string) (io.WriteCloser, error)
+	// Exists reports whether the named object is in the sink.
+	Exists(name string) (bool, error)
+	// Delete removes the named object, if it's there.
+	Delete(name string) error
+	// Close flushes anything the sink has buffered and releases its
+	// resources.
+	Close() error
+}
+
+// ErrSkip can be returned from the OnImage hook to leave an image unwritten
+// without reporting an error.
+var ErrSkip = errors.New("skipped")
+
+// ObjectName is the name a macro's image is stored under in a sink with
+// DefaultLayout.
+func ObjectName(m Macro) string {
+	return m.Name + ".gif"
+}
+
+// WriteObject writes an object to a sink in one go.
+func WriteObject(sink Sink, name string, body []byte) error {
+	w, err := sink.Put(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// DirSink is a Sink which writes objects as files under a local directory.
+// Each file is written to a temporary name and renamed into place once
+// complete, so a failed write never leaves a truncated image behind.
+type DirSink struct {
+	dir      string
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	mkdir    bool
+}
+
+// DirSinkOption configures a DirSink.
+type DirSinkOption func(*DirSink)
+
+// NewDirSink returns a sink which writes under dir. By default files are only
+// readable by their owner, and dir must already exist.
+func NewDirSink(dir string, options ...DirSinkOption) *DirSink {
+	s := &DirSink{dir: dir, fileMode: 0600, dirMode: 0700}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// WithFileMode sets the permissions files are written with.
+func WithFileMode(mode os.FileMode) DirSinkOption {
+	return func(s *DirSink) { s.fileMode = mode }
+}
+
+// WithMkdir makes Open create the directory and any missing parents, and sets
+// the permissions those and any subdirectories are created with.
+func WithMkdir(mode os.FileMode) DirSinkOption {
+	return func(s *DirSink) {
+		s.mkdir = true
+		s.dirMode = mode
+	}
+}
+
+// Dir returns the directory the sink writes under.
+func (s *DirSink) Dir() string { return s.dir }
+
+// Path returns the file an object is written to.
+func (s *DirSink) Path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+// Open checks that the directory exists, creating it if the sink was made
+// with WithMkdir.
+func (s *DirSink) Open() error {
+	if s.mkdir {
+		return os.MkdirAll(s.dir, s.dirMode)
+	}
+	info, err := os.Stat(s.dir)
+	if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s isn't a directory", s.dir)
+	}
+	return nil
+}
+
+// Refuse names which would escape the directory.
+func (s *DirSink) checkName(name string) error {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return fmt.Errorf("invalid object name %q", name)
+	}
+	return nil
+}
+
+func (s *DirSink) Put(name string) (io.WriteCloser, error) {
+	if err := s.checkName(name); err != nil {
+		return nil, err
+	}
+	path := s.Path(name)
+	if err := os.MkdirAll(filepath.Dir(path), s.dirMode); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	return &dirSinkFile{File: f, path: path, mode: s.fileMode}, nil
+}
+
+func (s *DirSink) Exists(name string) (bool, error) {
+	if err := s.checkName(name); err != nil {
+		return false, err
+	}
+	_, err := os.Stat(s.Path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *DirSink) Delete(name string) error {
+	if err := s.checkName(name); err != nil {
+		return err
+	}
+	err := os.Remove(s.Path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Close does nothing, since every file is complete once its writer is closed.
+func (s *DirSink) Close() error { return nil }
+
+// A file being written to a DirSink under a temporary name.
+type dirSinkFile struct {
+	*os.File
+	path string
+	mode os.FileMode
+	err  error // the first failed write, if any
+}
+
+func (f *dirSinkFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// Move the file into place, unless writing it failed.
+func (f *dirSinkFile) Close() error {
+	err := f.File.Close()
+	if err == nil {
+		err = f.err
+	}
+	if err == nil {
+		err = os.Chmod(f.File.Name(), f.mode)
+	}
+	if err == nil {
+		err = os.Rename(f.File.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.File.Name())
+	}
+	return err
+}
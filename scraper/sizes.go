@@ -0,0 +1,143 @@
+package scraper
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The most PHIDs to ask file.search about in a single request.
+const fileSearchPageSize = 100
+
+// FillSizes looks up the size of each macro's image from the file metadata the
+// server offers, without downloading anything: file.search where available,
+// and file.info (one request per file, concurrency at a time) otherwise.
+// Macros whose size can't be found are left with a Size of 0, and the sizes
+// that were found are filled in even if an error is returned.
+func (c *Client) FillSizes(macros []Macro, concurrency int) error {
+	server, err := c.serverInfo()
+	if err != nil {
+		return err
+	}
+
+	byPHID := make(map[string][]*Macro)
+	var phids []string
+	for i := range macros {
+		phid := macros[i].FilePHID
+		if byPHID[phid] == nil {
+			phids = append(phids, phid)
+		}
+		byPHID[phid] = append(byPHID[phid], &macros[i])
+	}
+
+	var sizes map[string]int64
+	switch {
+	case server.Has("file.search"):
+		sizes, err = c.searchFileSizes(phids)
+	case server.Has("file.info"):
+		sizes, err = c.fileInfoSizes(phids, concurrency)
+	default:
+		return nil
+	}
+
+	// Whatever sizes were found are kept even if looking up others failed.
+	for phid, size := range sizes {
+		for _, m := range byPHID[phid] {
+			m.Size = size
+		}
+	}
+	return err
+}
+
+// Look up file sizes with file.search, a page of PHIDs at a time. The sizes
+// found before any error are returned along with it.
+func (c *Client) searchFileSizes(phids []string) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	for start := 0; start < len(phids); start += fileSearchPageSize {
+		end := start + fileSearchPageSize
+		if end > len(phids) {
+			end = len(phids)
+		}
+
+		params := map[string]string{"limit": strconv.Itoa(fileSearchPageSize)}
+		for i, phid := range phids[start:end] {
+			params[fmt.Sprintf("constraints[phids][%d]", i)] = phid
+		}
+
+		err := c.searchAll("file.search", params, func(phid string, fields json.RawMessage) error {
+			var file struct {
+				Size conduitInt `json:"size"`
+			}
+			if err := json.Unmarshal(fields, &file); err != nil {
+				return err
+			}
+			sizes[phid] = int64(file.Size)
+			return nil
+		})
+		if err != nil {
+			return sizes, err
+		}
+	}
+	return sizes, nil
+}
+
+// Look up file sizes with file.info, one file per request, concurrency at a
+// time. Every size that could be found is returned, along with the first
+// error.
+func (c *Client) fileInfoSizes(phids []string, concurrency int) (map[string]int64, error) {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		sizes    = make(map[string]int64)
+		firstErr error
+		pending  = make(chan string)
+	)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for phid := range pending {
+				var file struct {
+					ByteSize conduitInt `json:"byteSize"`
+				}
+				err := c.Call("file.info", map[string]string{"phid": phid}, &file)
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				} else if err == nil {
+					sizes[phid] = int64(file.ByteSize)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, phid := range phids {
+		pending <- phid
+	}
+	close(pending)
+	wg.Wait()
+
+	return sizes, firstErr
+}
+
+// conduitInt is an integer, which older Conduit methods such as file.info
+// send as a string.
+type conduitInt int64
+
+func (i *conduitInt) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", data)
+	}
+	*i = conduitInt(n)
+	return nil
+}
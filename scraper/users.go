@@ -0,0 +1,271 @@
+package scraper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The most PHIDs to ask user.search or phid.lookup about in a single request.
+const userSearchPageSize = 100
+
+// How long a user cached by a UserCache is trusted before being looked up
+// again, in case they've been renamed.
+const userCacheTTL = 7 * 24 * time.Hour
+
+// How long a UserCache remembers that a PHID couldn't be found, so that a
+// macro by a deleted or bot account doesn't cost a lookup on every run. It's
+// shorter than userCacheTTL in case the account was only hidden from us.
+const userMissTTL = 24 * time.Hour
+
+// User is a Phabricator account, as far as macros are concerned.
+type User struct {
+	PHID     string `json:"phid"`
+	UserName string `json:"userName"`
+	RealName string `json:"realName,omitempty"`
+}
+
+// UserCache remembers the users FillAuthors has looked up, optionally in a
+// file so they needn't be looked up again on the next run. It's safe for
+// concurrent use, including by clients of different instances.
+type UserCache struct {
+	path string
+
+	mu    sync.Mutex
+	users map[string]cachedUser // by host and PHID, e.g. "phab.example.com PHID-USER-..."
+}
+
+type cachedUser struct {
+	User
+	Fetched time.Time `json:"fetched"`
+	Missing bool      `json:"missing,omitempty"` // the user couldn't be found
+}
+
+// NewUserCache returns an empty cache kept only in memory.
+func NewUserCache() *UserCache {
+	return &UserCache{users: make(map[string]cachedUser)}
+}
+
+// LoadUserCache reads a cache from a file written by Save, returning an empty
+// cache if the file doesn't exist yet.
+func LoadUserCache(path string) (*UserCache, error) {
+	c := NewUserCache()
+	c.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.users); err != nil {
+		return nil, fmt.Errorf("invalid user cache %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Save writes the cache back to the file it was loaded from, if any.
+func (c *UserCache) Save() error {
+	if c == nil || c.path == "" {
+		return nil
+	}
+	c.mu.Lock()
+	data, err := json.MarshalIndent(c.users, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sink := NewDirSink(filepath.Dir(c.path))
+	return WriteObject(sink, filepath.Base(c.path), append(data, '\n'))
+}
+
+// WithAuthors looks up the usernames and real names of macros' authors with
+// FillAuthors, so they're in the manifest and can be used by layouts. Authors
+// are looked up regardless when a Filter selects by them. The cache may be
+// nil.
+func WithAuthors(cache *UserCache) Option {
+	return func(s *Scraper) {
+		if cache == nil {
+			cache = NewUserCache()
+		}
+		s.users = cache
+	}
+}
+
+func (c *UserCache) get(host, phid string) (User, bool) {
+	if c == nil {
+		return User{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u, ok := c.users[host+" "+phid]
+	ttl := userCacheTTL
+	if u.Missing {
+		ttl = userMissTTL
+	}
+	if !ok || time.Since(u.Fetched) > ttl {
+		return User{}, false
+	}
+	return u.User, true
+}
+
+func (c *UserCache) put(host string, u User) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users[host+" "+u.PHID] = cachedUser{User: u, Fetched: time.Now()}
+}
+
+// Remember that a PHID isn't a user that can be found.
+func (c *UserCache) putMissing(host, phid string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users[host+" "+phid] = cachedUser{User: User{PHID: phid}, Fetched: time.Now(), Missing: true}
+}
+
+// FillAuthors sets the AuthorName and AuthorRealName of each macro from its
+// AuthorPHID, looking up the users cache doesn't already know in batches: with
+// user.search where available, and phid.lookup otherwise. Authors which can't
+// be found, e.g. because they're bots, are left without names, and the cache
+// remembers that for less time than it remembers users. The cache may be nil.
+func (c *Client) FillAuthors(macros []Macro, cache *UserCache) error {
+	users := make(map[string]User)
+	var missing []string
+	for _, m := range macros {
+		phid := m.AuthorPHID
+		if _, ok := users[phid]; ok || phid == "" {
+			continue
+		}
+		u, ok := cache.get(c.Host, phid)
+		if !ok {
+			missing = append(missing, phid)
+		}
+		users[phid] = u
+	}
+
+	if len(missing) > 0 {
+		server, err := c.serverInfo()
+		if err != nil {
+			return err
+		}
+		var found []User
+		switch {
+		case server.Has("user.search"):
+			found, err = c.searchUsers(missing)
+		case server.Has("phid.lookup"):
+			found, err = c.lookupUsers(missing)
+		default:
+			return errors.New("the server has neither user.search nor phid.lookup")
+		}
+		if err != nil {
+			return err
+		}
+		for _, u := range found {
+			users[u.PHID] = u
+			cache.put(c.Host, u)
+		}
+		for _, phid := range missing {
+			if users[phid].PHID == "" {
+				cache.putMissing(c.Host, phid)
+			}
+		}
+	}
+
+	for i := range macros {
+		u := users[macros[i].AuthorPHID]
+		macros[i].AuthorName, macros[i].AuthorRealName = u.UserName, u.RealName
+	}
+	return nil
+}
+
+func (c *Client) searchUsers(phids []string) ([]User, error) {
+	var users []User
+	for start := 0; start < len(phids); start += userSearchPageSize {
+		end := start + userSearchPageSize
+		if end > len(phids) {
+			end = len(phids)
+		}
+		params := map[string]string{"limit": strconv.Itoa(userSearchPageSize)}
+		for i, phid := range phids[start:end] {
+			params[fmt.Sprintf("constraints[phids][%d]", i)] = phid
+		}
+
+		err := c.searchAll("user.search", params, func(phid string, fields json.RawMessage) error {
+			var user struct {
+				UserName string `json:"username"`
+				RealName string `json:"realName"`
+			}
+			if err := json.Unmarshal(fields, &user); err != nil {
+				return err
+			}
+			users = append(users, User{PHID: phid, UserName: user.UserName, RealName: user.RealName})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// phid.lookup predates user.search, and only gives a user's real name as part
+// of their "full name", e.g. "alice (Alice Liddell)".
+func (c *Client) lookupUsers(phids []string) ([]User, error) {
+	var users []User
+	for start := 0; start < len(phids); start += userSearchPageSize {
+		end := start + userSearchPageSize
+		if end > len(phids) {
+			end = len(phids)
+		}
+		params := make(map[string]string)
+		for i, phid := range phids[start:end] {
+			params[fmt.Sprintf("names[%d]", i)] = phid
+		}
+
+		// Like other PHP arrays, the result is a list rather than an object when
+		// nothing is found.
+		var raw json.RawMessage
+		if err := c.Call("phid.lookup", params, &raw); err != nil {
+			return nil, err
+		}
+		var result map[string]struct {
+			PHID     string `json:"phid"`
+			Type     string `json:"type"`
+			Name     string `json:"name"`
+			FullName string `json:"fullName"`
+		}
+		if trimmed := bytes.TrimSpace(raw); !bytes.HasPrefix(trimmed, []byte("[")) {
+			if err := json.Unmarshal(trimmed, &result); err != nil {
+				return nil, fmt.Errorf("phid.lookup: unexpected result: %v", err)
+			}
+		}
+		for _, object := range result {
+			if object.Type != "USER" {
+				continue
+			}
+			realName := strings.TrimPrefix(object.FullName, object.Name+" (")
+			if realName == object.FullName || !strings.HasSuffix(realName, ")") {
+				realName = ""
+			}
+			users = append(users, User{
+				PHID:     object.PHID,
+				UserName: object.Name,
+				RealName: strings.TrimSuffix(realName, ")"),
+			})
+		}
+	}
+	return users, nil
+}
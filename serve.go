@@ -0,0 +1,400 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+// How long clients may reuse a response before checking it's still current.
+// Macros rarely change, but a scrape can change them at any time.
+const serveMaxAge = 5 * time.Minute
+
+// The most macros a search returns unless asked for more, and the most it
+// can be asked for.
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 1000
+)
+
+// The serve command serves a scrape's output directory over HTTP, with a JSON
+// API for finding macros, so bots can look them up without asking Phabricator:
+//
+//	GET /macros?q=party        macros whose names match, best first
+//	GET /macros/{name}         a macro's details
+//	GET /macros/{name}/image   its image
+//
+// A new scrape into the directory is picked up without restarting.
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	dir := flags.String("dir", "", "the output directory of a scrape")
+	addr := flags.String("addr", "127.0.0.1:8080", "the address to listen on")
+	flags.Parse(args)
+
+	if *dir == "" {
+		return errors.New("please specify the scrape's -dir")
+	}
+	s := &mirrorServer{dir: *dir, log: slog.New(slog.NewTextHandler(os.Stderr, nil))}
+	macros, err := s.current()
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Serving %d macros from %s on http://%s/macros\n", len(macros), *dir, listener.Addr())
+
+	// Slow or stalled clients mustn't be able to tie up connections forever.
+	server := &http.Server{
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+	return server.Serve(listener)
+}
+
+// mirrorServer answers API requests from the manifests in a directory,
+// rereading them whenever one changes.
+type mirrorServer struct {
+	dir string
+	log *slog.Logger
+
+	mu       sync.Mutex
+	macros   []servedMacro        // sorted by name, then host
+	modTimes map[string]time.Time // of each manifest when it was read
+}
+
+// A macro in the mirror, and which instance it's from.
+type servedMacro struct {
+	inst  mirroredInstance
+	entry scraper.ManifestEntry
+}
+
+// The macros as of the last scrape. Failing to reread them once they've been
+// read isn't fatal: the old ones are served until the new ones can be read.
+func (s *mirrorServer) current() ([]servedMacro, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.modTimes != nil && !s.changed() {
+		return s.macros, nil
+	}
+
+	mirror, err := readMirror(s.dir)
+	if err != nil {
+		if s.modTimes == nil {
+			return nil, err
+		}
+		s.log.Warn("failed to reread macros", "error", err)
+		return s.macros, nil
+	}
+
+	var macros []servedMacro
+	modTimes := make(map[string]time.Time)
+	for _, inst := range mirror {
+		path := filepath.Join(inst.dir, scraper.ManifestName)
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+		for _, entry := range inst.manifest.Macros {
+			macros = append(macros, servedMacro{inst: inst, entry: entry})
+		}
+	}
+	sort.SliceStable(macros, func(i, j int) bool { return macros[i].entry.Name < macros[j].entry.Name })
+	s.macros, s.modTimes = macros, modTimes
+	return macros, nil
+}
+
+// Whether a manifest has been rewritten since it was read, or one has appeared
+// or disappeared, as scraping another instance into the directory would do.
+func (s *mirrorServer) changed() bool {
+	dirs, err := findManifests(s.dir)
+	if err != nil || len(dirs) != len(s.modTimes) {
+		return true
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, scraper.ManifestName)
+		modTime, ok := s.modTimes[path]
+		if !ok {
+			return true
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *mirrorServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/macros", s.search)
+	mux.HandleFunc("/macros/", func(w http.ResponseWriter, r *http.Request) {
+		name, image := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/macros/"), "/image")
+		switch {
+		case name == "" || strings.Contains(name, "/"):
+			http.NotFound(w, r)
+		case image:
+			s.image(w, r, name)
+		default:
+			s.macro(w, r, name)
+		}
+	})
+	return readOnly(mux)
+}
+
+// Refuse anything but reads.
+func readOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeAPIError(w, http.StatusMethodNotAllowed, "only GET and HEAD are allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// A macro as the API describes it.
+type apiMacro struct {
+	Name       string    `json:"name"`
+	Host       string    `json:"host,omitempty"`
+	Author     string    `json:"author,omitempty"`
+	AuthorName string    `json:"authorName,omitempty"`
+	AuthorPHID string    `json:"authorPHID,omitempty"`
+	FilePHID   string    `json:"filePHID"`
+	Created    time.Time `json:"created"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	Image      string    `json:"image"` // the URL of the image, relative to the server
+}
+
+func describeMacro(m servedMacro) apiMacro {
+	return apiMacro{
+		Name:       m.entry.Name,
+		Host:       m.inst.manifest.Host,
+		Author:     m.entry.Author,
+		AuthorName: m.entry.AuthorName,
+		AuthorPHID: m.entry.AuthorPHID,
+		FilePHID:   m.entry.FilePHID,
+		Created:    m.entry.Created,
+		Size:       m.entry.Size,
+		SHA256:     m.entry.SHA256,
+		Image:      "/macros/" + url.PathEscape(m.entry.Name) + "/image",
+	}
+}
+
+func (s *mirrorServer) search(w http.ResponseWriter, r *http.Request) {
+	macros, err := s.current()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	limit := defaultSearchLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxSearchLimit {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("limit must be from 1 to %d", maxSearchLimit))
+			return
+		}
+	}
+	host := r.URL.Query().Get("host")
+
+	var matches []servedMacro
+	for _, m := range searchMacros(macros, r.URL.Query().Get("q")) {
+		if host == "" || m.inst.manifest.Host == host {
+			matches = append(matches, m)
+		}
+	}
+	result := struct {
+		Macros []apiMacro `json:"macros"`
+		Total  int        `json:"total"` // matches, including those beyond the limit
+	}{Macros: []apiMacro{}, Total: len(matches)}
+	for i := 0; i < len(matches) && i < limit; i++ {
+		result.Macros = append(result.Macros, describeMacro(matches[i]))
+	}
+	writeAPIResult(w, r, result)
+}
+
+func (s *mirrorServer) macro(w http.ResponseWriter, r *http.Request, name string) {
+	if m, ok := s.find(w, r, name); ok {
+		writeAPIResult(w, r, describeMacro(m))
+	}
+}
+
+// An image's ETag is its SHA-256, so it stays the same across scrapes until
+// the image changes.
+func (s *mirrorServer) image(w http.ResponseWriter, r *http.Request, name string) {
+	m, ok := s.find(w, r, name)
+	if !ok {
+		return
+	}
+	file, err := m.inst.imagePath(m.entry)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "the image for "+m.entry.Name+" is missing")
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("ETag", `"`+m.entry.SHA256+`"`)
+	w.Header().Set("Cache-Control", cacheControl())
+	http.ServeContent(w, r, path.Base(m.entry.Path), info.ModTime(), f)
+}
+
+// Look up a macro by name, from the instance given by ?host= if several were
+// scraped, responding with an error if there's no such macro.
+func (s *mirrorServer) find(w http.ResponseWriter, r *http.Request, name string) (servedMacro, bool) {
+	macros, err := s.current()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return servedMacro{}, false
+	}
+	host := r.URL.Query().Get("host")
+	i := sort.Search(len(macros), func(i int) bool { return macros[i].entry.Name >= name })
+	for ; i < len(macros) && macros[i].entry.Name == name; i++ {
+		if host == "" || macros[i].inst.manifest.Host == host {
+			return macros[i], true
+		}
+	}
+	writeAPIError(w, http.StatusNotFound, "no macro named "+name)
+	return servedMacro{}, false
+}
+
+// Order the macros by how well their names match a query: exact matches first,
+// then those starting with it, then those containing it, and finally those
+// containing its characters in order, tightest first. Macros that don't match
+// at all are left out, and an empty query matches everything.
+func searchMacros(macros []servedMacro, q string) []servedMacro {
+	q = strings.ToLower(strings.TrimSpace(q))
+	if q == "" {
+		return macros
+	}
+
+	type match struct {
+		macro       servedMacro
+		rank, score int
+	}
+	var matches []match
+	for _, m := range macros {
+		name := strings.ToLower(m.entry.Name)
+		switch {
+		case name == q:
+			matches = append(matches, match{m, 0, 0})
+		case strings.HasPrefix(name, q):
+			matches = append(matches, match{m, 1, len(name)})
+		case strings.Contains(name, q):
+			matches = append(matches, match{m, 2, strings.Index(name, q)})
+		default:
+			if spread, ok := fuzzyMatch(name, q); ok {
+				matches = append(matches, match{m, 3, spread})
+			}
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].rank != matches[j].rank {
+			return matches[i].rank < matches[j].rank
+		}
+		return matches[i].score < matches[j].score
+	})
+
+	result := make([]servedMacro, len(matches))
+	for i, m := range matches {
+		result[i] = m.macro
+	}
+	return result
+}
+
+// Whether name contains the characters of q in order, e.g. "ptyprrt" for
+// "partyparrot", and how many other characters lie between the first and
+// last of them.
+func fuzzyMatch(name, q string) (spread int, ok bool) {
+	want := []rune(q)
+	start, next := -1, 0
+	for i, c := range []rune(name) {
+		if next == len(want) {
+			break
+		}
+		if c == want[next] {
+			if start < 0 {
+				start = i
+			}
+			next++
+			spread = i - start + 1 - len(want)
+		}
+	}
+	return spread, next == len(want)
+}
+
+func cacheControl() string {
+	return fmt.Sprintf("public, max-age=%d", int(serveMaxAge.Seconds()))
+}
+
+// Write a JSON response with an ETag derived from it, or 304 Not Modified if
+// the client already has it.
+func writeAPIResult(w http.ResponseWriter, r *http.Request, result interface{}) {
+	body, err := json.Marshal(result)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl())
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// Whether an If-None-Match header lists the ETag, comparing weakly as RFC 9110
+// requires.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
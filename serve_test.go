@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tedkornish/scrape-phabricator-macros/scraper"
+)
+
+// Write images and their manifest into dir as a scrape of host would.
+func writeMirror(t *testing.T, dir, host string, images map[string]string) {
+	t.Helper()
+	sink := scraper.NewDirSink(dir, scraper.WithMkdir(0700))
+	if err := sink.Open(); err != nil {
+		t.Fatal(err)
+	}
+	manifest := &scraper.Manifest{Host: host, Generated: time.Now().UTC()}
+	for name, body := range images {
+		if err := scraper.WriteObject(sink, name+".gif", []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256([]byte(body))
+		manifest.Macros = append(manifest.Macros, scraper.ManifestEntry{
+			Name:   name,
+			Path:   name + ".gif",
+			Author: "alice",
+			Size:   int64(len(body)),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+	if err := manifest.Write(sink); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Serve a mirror directory's API from a test server.
+func newTestMirrorServer(t *testing.T, dir string) *httptest.Server {
+	t.Helper()
+	s := &mirrorServer{dir: dir, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	server := httptest.NewServer(s.handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Search a test server, returning the names of the macros found.
+func searchNames(t *testing.T, server *httptest.Server, query string) []string {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/macros?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("searching for %s: %s", query, resp.Status)
+	}
+	var result struct {
+		Macros []apiMacro `json:"macros"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, m := range result.Macros {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	tests := []struct {
+		name, q    string
+		wantSpread int
+		wantOK     bool
+	}{
+		{"partyparrot", "ptyprrt", 4, true},
+		{"partyparrot", "party", 0, true},
+		{"partyparrot", "pt", 2, true},
+		{"partyparrot", "tp", 1, true},
+		{"partyparrot", "parrots", 0, false},
+		{"cat", "dog", 0, false},
+		{"shrug", "", 0, true},
+	}
+	for _, test := range tests {
+		spread, ok := fuzzyMatch(test.name, test.q)
+		if ok != test.wantOK || (ok && spread != test.wantSpread) {
+			t.Errorf("fuzzyMatch(%q, %q) = %d, %v, want %d, %v", test.name, test.q, spread, ok, test.wantSpread, test.wantOK)
+		}
+	}
+}
+
+func TestSearchMacros(t *testing.T) {
+	var macros []servedMacro
+	for _, name := range []string{"cat", "catparty", "partycat", "party", "partyparrot", "pizza"} {
+		macros = append(macros, servedMacro{entry: scraper.ManifestEntry{Name: name}})
+	}
+
+	tests := []struct {
+		q    string
+		want string
+	}{
+		// Exact, then prefixes, shortest first, then substrings, earliest
+		// first, then fuzzy matches, tightest first.
+		{"party", "party,partycat,partyparrot,catparty"},
+		{"  PARTY ", "party,partycat,partyparrot,catparty"},
+		{"cat", "cat,catparty,partycat"},
+		{"pa", "party,partycat,partyparrot,catparty,pizza"},
+		{"pz", "pizza"},
+		{"ay", "partycat,party,partyparrot,catparty"},
+		{"nothing", ""},
+		{"", "cat,catparty,partycat,party,partyparrot,pizza"},
+	}
+	for _, test := range tests {
+		var names []string
+		for _, m := range searchMacros(macros, test.q) {
+			names = append(names, m.entry.Name)
+		}
+		if got := strings.Join(names, ","); got != test.want {
+			t.Errorf("searching for %q found %s, want %s", test.q, got, test.want)
+		}
+	}
+}
+
+func TestServeETag(t *testing.T) {
+	dir := t.TempDir()
+	writeMirror(t, dir, "https://phab.example.com", map[string]string{"party": "GIF89a party"})
+	server := newTestMirrorServer(t, dir)
+
+	for _, path := range []string{"/macros?q=party", "/macros/party", "/macros/party/image"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		etag := resp.Header.Get("ETag")
+		if resp.StatusCode != http.StatusOK || etag == "" {
+			t.Fatalf("GET %s: %s with ETag %q", path, resp.Status, etag)
+		}
+
+		for header, want := range map[string]int{
+			etag:                    http.StatusNotModified,
+			"W/" + etag:             http.StatusNotModified,
+			`"other", ` + etag:      http.StatusNotModified,
+			"*":                     http.StatusNotModified,
+			`"other"`:               http.StatusOK,
+			strings.Trim(etag, `"`): http.StatusOK,
+		} {
+			req, err := http.NewRequest("GET", server.URL+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("If-None-Match", header)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != want {
+				t.Errorf("GET %s with If-None-Match %s: %s, want %d", path, header, resp.Status, want)
+			}
+		}
+	}
+
+	// An image's ETag is its content hash, whatever the response.
+	resp, err := http.Get(server.URL + "/macros/party/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	sum := sha256.Sum256([]byte("GIF89a party"))
+	if got, want := resp.Header.Get("ETag"), `"`+hex.EncodeToString(sum[:])+`"`; got != want {
+		t.Errorf("image ETag is %s, want %s", got, want)
+	}
+}
+
+func TestServeNewManifest(t *testing.T) {
+	dir := t.TempDir()
+	writeMirror(t, filepath.Join(dir, "phab.example.com"), "https://phab.example.com", map[string]string{"party": "GIF89a party"})
+	server := newTestMirrorServer(t, dir)
+
+	if got := strings.Join(searchNames(t, server, ""), ","); got != "party" {
+		t.Fatalf("serving %s, want party", got)
+	}
+
+	// Scraping another instance into the directory adds a manifest without
+	// touching the first.
+	writeMirror(t, filepath.Join(dir, "phorge.example.com"), "https://phorge.example.com", map[string]string{"shipit": "GIF89a shipit"})
+	if got := strings.Join(searchNames(t, server, ""), ","); got != "party,shipit" {
+		t.Errorf("serving %s after a new scrape, want party,shipit", got)
+	}
+
+	if err := os.RemoveAll(filepath.Join(dir, "phab.example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(searchNames(t, server, ""), ","); got != "shipit" {
+		t.Errorf("serving %s after removing an instance, want shipit", got)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	liburl "net/url"
+	"os"
+)
+
+// transportOptions describe how the client should reach the Phabricator
+// instance: which certificate authorities to trust, which client certificate
+// to present, and which proxy to go through.
+type transportOptions struct {
+	caBundle           string // path to a PEM file of additional trusted CAs
+	clientCert         string // path to a PEM client certificate for mutual TLS
+	clientKey          string // path to the PEM private key for clientCert
+	insecureSkipVerify bool
+	proxy              string // http, https or socks5 proxy URL
+}
+
+// Build an HTTP client from the given options. Anything left unset falls back
+// to the behavior of http.DefaultTransport, including honoring the
+// HTTP_PROXY/HTTPS_PROXY environment variables.
+func newHTTPClient(opts transportOptions) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	if opts.proxy != "" {
+		proxyURL, err := liburl.Parse(opts.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+func (opts transportOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: opts.insecureSkipVerify}
+
+	// Extend rather than replace the system pool so a bundle holding only the
+	// internal CA doesn't break hosts signed by a public one.
+	if opts.caBundle != "" {
+		pem, err := os.ReadFile(opts.caBundle)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.caBundle)
+		}
+		config.RootCAs = pool
+	}
+
+	if (opts.clientCert == "") != (opts.clientKey == "") {
+		return nil, errors.New("-clientCert and -clientKey must be specified together")
+	}
+	if opts.clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.clientCert, opts.clientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}